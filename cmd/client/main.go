@@ -1,79 +1,77 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/Azpect3120/TCPNotificationManager/internal/client"
 	"github.com/Azpect3120/TCPNotificationManager/internal/events"
 	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
 )
 
+// The client runs as a daemon on each desktop. It holds the connection to the
+// server, shows the notifications, and accepts requests from other programs on
+// the desktop over its IPC socket, see 'tnm notify'.
 func main() {
-	c := client.NewTCPClient(client.WithPort(3005), client.WithAddr("vpn.gophernest.net"))
-	conn := c.Configure("./certs/client.crt", "./certs/client.key", "vpn.gophernest.net").Connect()
+	c := client.NewTCPClient(client.WithPort(3005), client.WithAddr("vpn.gophernest.net"), client.WithTLS(), client.WithIPCSocket(client.DefaultIPCSocket(), 0600))
+	conn := c.Configure("./certs/client.crt", "./certs/client.key", "./certs/ca.crt", "vpn.gophernest.net").Connect()
 	for _, err := range c.Errors {
 		panic(err)
 	}
 
-	// Graceful shutdown handling, capture SIGINT and SIGTERM
-	// Capture Ctrl+C (SIGINT) and other termination requests (SIGTERM)
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	// Graceful shutdown handling, capture SIGINT and SIGTERM. Disconnecting
+	// closes the connection, which stops the read loop below.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	go func() {
-		<-sigchan
-		// Instead of using defer, this logic works the same way, for
-		// testing.
-		// TODO: Likely needs to change in production.
+		<-ctx.Done()
 		c.Disconnect(conn)
-		os.Exit(0)
 	}()
 
-	for _, err := range c.Errors {
-		panic(err)
-	}
-
-	// Once connected, we need to authenticate with the server
-	msg, err := json.Marshal(events.NewRequestAuthenticationEvent(""))
-	if err != nil {
-		panic(err)
-	}
-
-	conn.Write(msg)
-
-	// Create a simple UI for sending messages via the terminal
+	// Requests wait on the read loop below for their response, so they
+	// must be made in a separate goroutine.
+	ipcDone := make(chan struct{})
 	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			line := scanner.Text()
-			c.Logger.Log(fmt.Sprintf("Sending message: %s\n", line), logger.DEBUG)
-			if msg, err := json.Marshal(events.NewSendMessageEvent(c.ID, line)); err != nil {
-				c.Logger.Log(fmt.Sprintf("Error marshaling message: %s\n", err), logger.ERROR)
-			} else {
-				conn.Write(msg)
-			}
-		}
-	}()
+		defer close(ipcDone)
 
-	buf := make([]byte, 1024)
-	for {
-		n, err := conn.Read(buf)
-		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
-			// Connection closed, can exit safely
+		// Once connected, we need to authenticate with the server
+		auth := events.NewRequestAuthenticationEvent("")
+		if _, err := request(c, conn, &auth); err != nil {
+			c.Logger.Log(fmt.Sprintf("Error authenticating: %s\n", err), logger.ERROR)
+			stop()
 			return
-		} else if err != nil {
-			// Other error, for now, panic
-			panic(err)
 		}
-		if n > 0 {
-			c.HandleMessage(buf[:n])
+
+		// Serve the other programs on the desktop until the client stops.
+		if err := c.ServeIPC(ctx, conn); err != nil {
+			c.Logger.Log(fmt.Sprintf("Error serving IPC socket: %s\n", err), logger.ERROR)
 		}
+	}()
+
+	// Read the events sent by the server until the connection is closed
+	err := c.Listen(conn)
+
+	// Stop the IPC socket once the connection is gone, so requests are not
+	// accepted without a server to send them to.
+	stop()
+	<-ipcDone
+
+	if err != nil {
+		// Other error, for now, panic
+		panic(err)
 	}
+	os.Exit(0)
+}
+
+// Send a request to the server and wait for the response, giving up if the
+// server has not responded within the request timeout.
+func request(c *client.TcpClient, conn net.Conn, event events.Event) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return c.Request(ctx, conn, event)
 }
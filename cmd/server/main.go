@@ -1,32 +1,115 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
 	"github.com/Azpect3120/TCPNotificationManager/internal/server"
 )
 
 // TODO: Implement port backtesting. When when fails, try the next one until we get a open port.
 func main() {
-	s := server.NewTCPServer(server.WithPort(3005), server.WithTLS(), server.WithMaxConn(2))
-	ln := s.Configure("./certs/server.crt", "./certs/server.key").Listen()
-	for _, err := range s.Errors {
-		panic(err)
+	opts := []server.ServerOptsFunc{server.WithPort(3005), server.WithTLS(), server.WithMaxConn(2), server.WithRevocationList("./certs/revoked.txt"), server.WithWebSocket(3007, "/ws")}
+
+	// The Unix socket is only created when its users have been provided, the
+	// file maps the user ID of each local user to its identity. Connections
+	// over the socket do not use certificates, so the socket also requires a
+	// policy, otherwise every user in the group of the socket would be able
+	// to do everything.
+	if data, err := os.ReadFile("./unix-users.json"); err == nil {
+		if _, err := os.Stat("./policy.json"); err != nil {
+			panic(errors.New("the Unix socket requires a policy, create ./policy.json or remove ./unix-users.json"))
+		}
+
+		var users map[uint32]string
+		if err := json.Unmarshal(data, &users); err != nil {
+			panic(fmt.Errorf("failed to parse Unix users ./unix-users.json: %s", err))
+		}
+		opts = append(opts, server.WithUnixSocket("./tnm.sock", 0660), server.WithUnixUsers(users))
+	}
+
+	// The HTTP gateway is only started when tokens have been provided, the
+	// file maps the name of each publisher to its token.
+	if data, err := os.ReadFile("./tokens.json"); err == nil {
+		var tokens map[string]string
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			panic(fmt.Errorf("failed to parse tokens ./tokens.json: %s", err))
+		}
+		opts = append(opts, server.WithHTTPGateway("127.0.0.1:3006", tokens))
+
+		// Generic alert receivers, keyed by the name of the receiver. The
+		// Alertmanager receiver does not need to be configured.
+		if data, err := os.ReadFile("./alerts.json"); err == nil {
+			var mappings map[string]server.AlertMapping
+			if err := json.Unmarshal(data, &mappings); err != nil {
+				panic(fmt.Errorf("failed to parse alert receivers ./alerts.json: %s", err))
+			}
+			opts = append(opts, server.WithAlertMappings(mappings))
+		}
+	}
+
+	// Webhooks are only delivered when they have been provided, the file is
+	// a list of webhooks, see the server.Webhook type for the fields.
+	if data, err := os.ReadFile("./webhooks.json"); err == nil {
+		var webhooks []server.Webhook
+		if err := json.Unmarshal(data, &webhooks); err != nil {
+			panic(fmt.Errorf("failed to parse webhooks ./webhooks.json: %s", err))
+		}
+		opts = append(opts, server.WithWebhooks(webhooks...), server.WithWebhookDeadLetter("./webhooks-dead.jsonl"))
+	}
+
+	// The SMTP listener is only started when mailboxes have been provided,
+	// the file maps the address of each mailbox to its publisher and topic.
+	if data, err := os.ReadFile("./mailboxes.json"); err == nil {
+		var mailboxes map[string]server.SMTPMailbox
+		if err := json.Unmarshal(data, &mailboxes); err != nil {
+			panic(fmt.Errorf("failed to parse mailboxes ./mailboxes.json: %s", err))
+		}
+		opts = append(opts, server.WithSMTP("127.0.0.1:2525", mailboxes))
+	}
+
+	// The checks are optional, the file maps the name of each check to its
+	// interval and grace period, such as {"backup": {"interval": "24h"}}.
+	if data, err := os.ReadFile("./monitors.json"); err == nil {
+		var monitors map[string]server.Monitor
+		if err := json.Unmarshal(data, &monitors); err != nil {
+			panic(fmt.Errorf("failed to parse monitors ./monitors.json: %s", err))
+		}
+		opts = append(opts, server.WithMonitors(monitors))
+	}
+
+	s := server.NewTCPServer(opts...)
+
+	// The policy is optional, without it every device is allowed to do everything.
+	if _, err := os.Stat("./policy.json"); err == nil {
+		s.ConfigurePolicy("./policy.json")
 	}
-	defer ln.Close()
 
-	// Start listening
-	s.Logger.Log(fmt.Sprintf("Server started on %s:%d\n", s.Opts.Addr, s.Opts.Port))
+	s.Configure("./certs/server.crt", "./certs/server.key", "./certs/ca.crt")
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			s.Logger.Log(fmt.Sprintf("Error accepting connection: %s\n", err), logger.ERROR)
-			return
+	// Reload the certificates and revocation list when the server receives
+	// SIGHUP, this is done without dropping the connected clients.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.ReloadTLS()
 		}
-		defer conn.Close()
+	}()
+
+	// Shut down gracefully when the server receives SIGTERM or SIGINT, the
+	// clients are given some time to receive their queued events.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-		go s.HandleConnection(conn)
+	s.Logger.Log(fmt.Sprintf("Server starting on %s:%d\n", s.Opts.Addr, s.Opts.Port))
+	if err := s.ListenAndServe(ctx); !errors.Is(err, server.ErrServerClosed) {
+		panic(err)
 	}
+	s.Logger.Log("Server stopped\n")
 }
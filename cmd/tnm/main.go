@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Usage of the tnm command, printed when no command or an unknown
+// command is provided.
+const usage = `Usage: tnm <command> [arguments]
+
+Commands:
+  pki      Manage the certificate authority and certificates used for mTLS
+  notify   Send and read notifications through the client daemon
+`
+
+// tnm is the admin tool for the notification manager. Each command is
+// implemented in its own file, and is passed the remaining arguments.
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "pki":
+		err = pkiCommand(os.Args[2:])
+	case "notify":
+		err = notifyCommand(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tnm %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
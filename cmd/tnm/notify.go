@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/client"
+)
+
+const notifyUsage = `Usage: tnm notify <command> [flags] [arguments]
+
+Commands:
+  send     Publish a message through the client daemon
+  recent   List the recent messages received by the client daemon
+  read     Mark messages as read, every message when no IDs are provided
+  dnd      Enable or disable do not disturb, 'on' or 'off'
+  status   Show the state of the client daemon
+
+Run 'tnm notify <command> -h' for the flags of each command.
+`
+
+// Response to a request sent to the client daemon, with the result left
+// encoded so it can be decoded into the result type of the command.
+type notifyResponse struct {
+	OK     bool             `json:"ok"`
+	Result json.RawMessage  `json:"result"`
+	Error  *client.IPCError `json:"error"`
+}
+
+// Handle the notify command. Each command sends a single request to the IPC
+// socket of the client daemon running on this desktop, see cmd/client.
+func notifyCommand(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, notifyUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "send":
+		return notifySend(args[1:])
+	case "recent":
+		return notifyRecent(args[1:])
+	case "read":
+		return notifyRead(args[1:])
+	case "dnd":
+		return notifyDoNotDisturb(args[1:])
+	case "status":
+		return notifyStatus(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, notifyUsage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+// Publish a message, the arguments are joined to form the message.
+func notifySend(args []string) error {
+	fs := flag.NewFlagSet("notify send", flag.ExitOnError)
+	socket := fs.String("socket", client.DefaultIPCSocket(), "path of the client daemon's IPC socket")
+	title := fs.String("title", "", "title of the message")
+	topic := fs.String("topic", "", "topic of the message")
+	priority := fs.String("priority", "", "priority of the message: low, normal, high or urgent")
+	fs.Parse(args)
+
+	message := strings.Join(fs.Args(), " ")
+	if message == "" {
+		return fmt.Errorf("a message is required")
+	}
+
+	var result client.IPCPublishResult
+	req := client.IPCRequest{Command: client.IPCPublish, Message: message, Title: *title, Topic: *topic, Priority: *priority}
+	if err := notifyRequest(*socket, req, &result); err != nil {
+		return err
+	}
+
+	if result.Delivered != nil {
+		fmt.Printf("Message delivered to %d client(s)\n", *result.Delivered)
+	} else {
+		fmt.Println("Message sent")
+	}
+	return nil
+}
+
+// List the recent messages, newest first.
+func notifyRecent(args []string) error {
+	fs := flag.NewFlagSet("notify recent", flag.ExitOnError)
+	socket := fs.String("socket", client.DefaultIPCSocket(), "path of the client daemon's IPC socket")
+	limit := fs.Int("n", 10, "max number of messages to list, every message when 0")
+	unread := fs.Bool("unread", false, "only list the messages which have not been read")
+	fs.Parse(args)
+
+	var result client.IPCRecentResult
+	if err := notifyRequest(*socket, client.IPCRequest{Command: client.IPCRecent, Limit: *limit, Unread: *unread}, &result); err != nil {
+		return err
+	}
+
+	for _, msg := range result.Messages {
+		state := " "
+		if !msg.Read {
+			state = "*"
+		}
+
+		title := msg.Sender
+		if msg.Title != "" {
+			title = msg.Title
+		}
+		fmt.Printf("%s %4d  %s  %s: %s\n", state, msg.ID, msg.Timestamp.Local().Format(time.DateTime), title, msg.Message)
+	}
+	return nil
+}
+
+// Mark the messages with the IDs in the arguments as read.
+func notifyRead(args []string) error {
+	fs := flag.NewFlagSet("notify read", flag.ExitOnError)
+	socket := fs.String("socket", client.DefaultIPCSocket(), "path of the client daemon's IPC socket")
+	fs.Parse(args)
+
+	var ids []uint64
+	for _, arg := range fs.Args() {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid message ID '%s'", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	var result client.IPCMarkReadResult
+	if err := notifyRequest(*socket, client.IPCRequest{Command: client.IPCMarkRead, IDs: ids}, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("Marked %d message(s) as read\n", result.Marked)
+	return nil
+}
+
+// Enable or disable do not disturb, or show whether it is enabled when no
+// argument is provided.
+func notifyDoNotDisturb(args []string) error {
+	fs := flag.NewFlagSet("notify dnd", flag.ExitOnError)
+	socket := fs.String("socket", client.DefaultIPCSocket(), "path of the client daemon's IPC socket")
+	fs.Parse(args)
+
+	req := client.IPCRequest{Command: client.IPCDoNotDisturb}
+	switch fs.Arg(0) {
+	case "":
+	case "on":
+		enabled := true
+		req.Enabled = &enabled
+	case "off":
+		enabled := false
+		req.Enabled = &enabled
+	default:
+		return fmt.Errorf("expected 'on' or 'off', got '%s'", fs.Arg(0))
+	}
+
+	var result client.IPCDoNotDisturbResult
+	if err := notifyRequest(*socket, req, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("Do not disturb is %s\n", onOff(result.Enabled))
+	return nil
+}
+
+// Show the state of the client daemon.
+func notifyStatus(args []string) error {
+	fs := flag.NewFlagSet("notify status", flag.ExitOnError)
+	socket := fs.String("socket", client.DefaultIPCSocket(), "path of the client daemon's IPC socket")
+	fs.Parse(args)
+
+	var result client.IPCStatusResult
+	if err := notifyRequest(*socket, client.IPCRequest{Command: client.IPCStatus}, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("Client ID:      %s\n", result.ClientID)
+	fmt.Printf("Unread:         %d\n", result.Unread)
+	fmt.Printf("Do not disturb: %s\n", onOff(result.DoNotDisturb))
+	return nil
+}
+
+// Send a request to the client daemon and decode the result of the command
+// into result. A failed request is returned as the error.
+func notifyRequest(socket string, req client.IPCRequest, result interface{}) error {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("cannot connect to the client daemon: %w", err)
+	}
+	defer conn.Close()
+
+	// Publishing waits on the server, the daemon gives up after 10 seconds.
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("no response from the client daemon: %w", err)
+	}
+
+	var res notifyResponse
+	if err := json.Unmarshal(line, &res); err != nil {
+		return err
+	}
+	if !res.OK {
+		if res.Error == nil {
+			return fmt.Errorf("request failed")
+		}
+		return fmt.Errorf("%d %s", res.Error.Code, res.Error.Reason)
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+// Format a boolean as on or off.
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
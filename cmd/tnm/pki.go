@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/pki"
+)
+
+const pkiUsage = `Usage: tnm pki <command> [flags]
+
+Commands:
+  init     Create a new certificate authority
+  server   Issue the server certificate, signed by the CA
+  client   Issue a certificate for a client device, signed by the CA
+  revoke   Revoke the certificate of a client device
+
+Run 'tnm pki <command> -h' for the flags of each command.
+`
+
+// Handle the pki command. The CA is stored in the directory provided by the
+// -dir flag, along with every certificate it issues, see the pki package
+// for the layout of the directory.
+func pkiCommand(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, pkiUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "init":
+		return pkiInit(args[1:])
+	case "server":
+		return pkiServer(args[1:])
+	case "client":
+		return pkiClient(args[1:])
+	case "revoke":
+		return pkiRevoke(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, pkiUsage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+// Create a new certificate authority.
+func pkiInit(args []string) error {
+	fs := flag.NewFlagSet("pki init", flag.ExitOnError)
+	dir := fs.String("dir", "./certs", "directory to store the CA in")
+	name := fs.String("name", "Gophernest Notifications CA", "common name of the CA")
+	days := fs.Int("days", 3650, "number of days the CA is valid for")
+	fs.Parse(args)
+
+	ca, err := pki.InitCA(*dir, *name, daysToDuration(*days))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created CA '%s', valid until %s\n", ca.Cert.Subject.CommonName, ca.Cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Issue the server certificate.
+func pkiServer(args []string) error {
+	fs := flag.NewFlagSet("pki server", flag.ExitOnError)
+	dir := fs.String("dir", "./certs", "directory the CA is stored in")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "comma separated DNS names and IPs the clients connect to")
+	days := fs.Int("days", 365, "number of days the certificate is valid for")
+	fs.Parse(args)
+
+	ca, err := pki.LoadCA(*dir)
+	if err != nil {
+		return err
+	}
+
+	cert, err := ca.IssueServer(*dir, splitList(*hosts), daysToDuration(*days))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Issued server certificate for %v, valid until %s\n", splitList(*hosts), cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Issue a certificate for a client device.
+func pkiClient(args []string) error {
+	fs := flag.NewFlagSet("pki client", flag.ExitOnError)
+	dir := fs.String("dir", "./certs", "directory the CA is stored in")
+	device := fs.String("device", "", "name of the device, e.g. laptop-alice")
+	days := fs.Int("days", 365, "number of days the certificate is valid for")
+	fs.Parse(args)
+
+	if *device == "" {
+		return fmt.Errorf("the -device flag is required")
+	}
+
+	ca, err := pki.LoadCA(*dir)
+	if err != nil {
+		return err
+	}
+
+	cert, err := ca.IssueClient(*dir, *device, daysToDuration(*days))
+	if err != nil {
+		return err
+	}
+
+	certPath, keyPath := pki.ClientPaths(*dir, *device)
+	fmt.Printf("Issued client certificate for '%s' (serial %s), valid until %s\n", *device, cert.SerialNumber.Text(16), cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("Copy %s, %s and the CA certificate to the device\n", certPath, keyPath)
+	return nil
+}
+
+// Revoke the certificate of a client device. The running server reloads the
+// revocation list and disconnects the device.
+func pkiRevoke(args []string) error {
+	fs := flag.NewFlagSet("pki revoke", flag.ExitOnError)
+	dir := fs.String("dir", "./certs", "directory the CA is stored in")
+	device := fs.String("device", "", "name of the device, e.g. laptop-alice")
+	fs.Parse(args)
+
+	if *device == "" {
+		return fmt.Errorf("the -device flag is required")
+	}
+
+	cert, err := pki.Revoke(*dir, *device)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Revoked client certificate for '%s' (serial %s)\n", *device, cert.SerialNumber.Text(16))
+	fmt.Printf("The server will disconnect the device once it reloads %s\n", filepath.Join(*dir, pki.RevokedFile))
+	return nil
+}
+
+// Split a comma separated list, ignoring empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Convert a number of days into a duration.
+func daysToDuration(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
@@ -2,4 +2,4 @@ module github.com/Azpect3120/TCPNotificationManager
 
 go 1.23.3
 
-require github.com/google/uuid v1.6.0 // indirect
+require github.com/google/uuid v1.6.0
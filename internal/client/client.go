@@ -1,16 +1,30 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Azpect3120/TCPNotificationManager/internal/events"
 	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
 	"github.com/Azpect3120/TCPNotificationManager/internal/notify"
+	"github.com/Azpect3120/TCPNotificationManager/internal/pki"
+	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+	"github.com/Azpect3120/TCPNotificationManager/internal/wire"
 )
 
+// How long the client will wait for the server to respond to the hello
+// event before giving up on the connection.
+const handshakeTimeout = 10 * time.Second
+
 // Function symbol used to configure the client
 type ClientOptsFunc func(*ClientOpts)
 
@@ -24,6 +38,39 @@ type ClientOpts struct {
 
 	// Use TLS to secure the connection
 	TLS bool
+
+	// Size of the message buffer in bytes
+	MsgBufSize int
+
+	// Largest event, in bytes, the client will accept from the server.
+	// Larger events are discarded.
+	MaxEventSize int
+
+	// Optional protocol features the client will request
+	// during the handshake.
+	Features []string
+
+	// Size in bytes an event must reach before it is compressed,
+	// when compression is enabled for the connection.
+	CompressionThreshold int
+
+	// Path of the WebSocket endpoint of the server. When set, the
+	// client connects over WebSocket instead of raw TCP, the port
+	// must be the WebSocket port of the server.
+	WebSocketPath string
+
+	// Path of the server's Unix socket. When set, the client connects
+	// over the socket instead of TCP, and the address, port and TLS
+	// options are ignored.
+	UnixSocket string
+
+	// Path of the local socket other programs use to talk to the client,
+	// see ServeIPC, and the permissions of the socket file.
+	IPCSocket     string
+	IPCSocketMode os.FileMode
+
+	// Number of recent messages the client stores in its inbox.
+	InboxSize int
 }
 
 // Provide an address for the client to connect to.
@@ -47,13 +94,80 @@ func WithPort(port int) ClientOptsFunc {
 	}
 }
 
+// Provide a message buffer size for the client.
+func WithMsgBufSize(msgBufSize int) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.MsgBufSize = msgBufSize
+	}
+}
+
+// Provide the largest event, in bytes, the client will accept.
+func WithMaxEventSize(maxEventSize int) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.MaxEventSize = maxEventSize
+	}
+}
+
+// Provide the optional protocol features the client will request. A
+// feature is only enabled if the server also supports it.
+func WithFeatures(features ...string) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.Features = features
+	}
+}
+
+// Provide the size in bytes an event must reach before it is compressed.
+func WithCompressionThreshold(threshold int) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.CompressionThreshold = threshold
+	}
+}
+
+// Connect over WebSocket, using the path of the server's WebSocket endpoint.
+func WithWebSocket(path string) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.WebSocketPath = path
+	}
+}
+
+// Connect over the Unix socket of a server running on the same host.
+func WithUnixSocket(path string) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.UnixSocket = path
+	}
+}
+
+// Provide the path of the local socket other programs use to talk to the
+// client, and the permissions of the socket file.
+func WithIPCSocket(path string, mode os.FileMode) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.IPCSocket = path
+		opts.IPCSocketMode = mode
+	}
+}
+
+// Provide the number of recent messages the client stores in its inbox.
+func WithInboxSize(size int) ClientOptsFunc {
+	return func(opts *ClientOpts) {
+		opts.InboxSize = size
+	}
+}
+
 // Defines the default client options, if they are not
 // provided by the user.
 func defaultClientOpts() ClientOpts {
 	return ClientOpts{
-		Addr: "127.0.0.1",
-		Port: 8080,
-		TLS:  false,
+		Addr:         "127.0.0.1",
+		Port:         8080,
+		TLS:          false,
+		MsgBufSize:   1024,
+		MaxEventSize: wire.DefaultMaxFrameSize,
+		Features:     events.SupportedFeatures(),
+
+		CompressionThreshold: wire.DefaultCompressionThreshold,
+
+		IPCSocketMode: 0600,
+		InboxSize:     100,
 	}
 }
 
@@ -79,6 +193,11 @@ type TcpClient struct {
 	// ID of the client. This is generated by the server.
 	ID string
 
+	// Protocol version and optional features negotiated with the
+	// server during the handshake.
+	Version  int
+	Features []string
+
 	// Store any errors that occur during the server's lifecycle.
 	Errors []error
 
@@ -96,6 +215,21 @@ type TcpClient struct {
 
 	// Logger for the client, the default option will be info level.
 	Logger *logger.Logger
+
+	// Compression stats for the connection to the server.
+	Stats wire.Stats
+
+	// Requests which are waiting on a response from the server. The key
+	// is the request ID, and the value is the channel the response will
+	// be delivered on. The mutex must be held when using the map.
+	pending map[string]chan interface{}
+	mu      sync.Mutex
+
+	// The recent messages broadcast by the server, and whether desktop
+	// notifications are paused. Both can be used by other programs over
+	// the IPC socket.
+	inbox        *inbox
+	doNotDisturb atomic.Bool
 }
 
 // RegisterEventHandler registers an event handler for a specific event type.
@@ -126,6 +260,8 @@ func NewTCPClient(opts ...ClientOptsFunc) *TcpClient {
 
 	// Initialize the event handlers map
 	client.EventHandlers = make(map[string]interface{})
+	client.pending = make(map[string]chan interface{})
+	client.inbox = newInbox(client.Opts.InboxSize)
 
 	// When registering new events, make sure the event name matches the class name
 	// of the event. They must be a perfect match or the event will not be handled.
@@ -135,6 +271,9 @@ func NewTCPClient(opts ...ClientOptsFunc) *TcpClient {
 	RegisterEventHandler(client, "ClientAuthenticatedEvent", ClientAuthenticatedHandler)
 	RegisterEventHandler(client, "ClientDisconnectedEvent", ClientDisconnectedHandler)
 	RegisterEventHandler(client, "BroadcastMessageEvent", BroadcastMessageHandler)
+	RegisterEventHandler(client, "ErrorEvent", ErrorHandler)
+	RegisterEventHandler(client, "AckEvent", AckHandler)
+	RegisterEventHandler(client, "ServerShuttingDownEvent", ServerShuttingDownHandler)
 
 	return client
 }
@@ -143,37 +282,47 @@ func NewTCPClient(opts ...ClientOptsFunc) *TcpClient {
 // It is only required if you intend to use TLS, otherwise, there is no
 // need to run this function.
 //
+// The CA certificate is used to verify the server certificate, and the
+// server name must match one of the names in the server certificate. The
+// certificates can be created using the 'tnm pki' command.
+//
 // The client is returned to allow for method chaining.
 //
 // Errors will not be handled here, they will be stored in the client's
 // errors slice. If the files do not exist, or cannot be read, an error
 // will be stored in the client's errors slice.
-func (c *TcpClient) Configure(certPath, keyPath, serverName string) *TcpClient {
-	// NOTE: Learn how to use CA certificates
-	// caCert, err := os.ReadFile(caPath)
-	// if err != nil {
-	// 	c.Errors = append(c.Errors, err)
-	// }
-	//
-	// certPool := x509.NewCertPool()
-	// if !certPool.AppendCertsFromPEM(caCert) {
-	// 	c.Errors = append(c.Errors, errors.New("Failed to append CA certificate"))
-	// }
+func (c *TcpClient) Configure(certPath, keyPath, caPath, serverName string) *TcpClient {
+	config, err := LoadTLSConfig(certPath, keyPath, caPath, serverName)
+	if err != nil {
+		c.Errors = append(c.Errors, err)
+		return c
+	}
 
+	c.TLSConfig = config
+	return c
+}
+
+// LoadTLSConfig loads the client certificate and the CA certificate used to
+// verify the server, see Configure. Unlike Configure, the error is returned
+// to the caller, which allows the config to be loaded by programs embedding
+// the client.
+func LoadTLSConfig(certPath, keyPath, caPath, serverName string) (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err != nil {
-		c.Errors = append(c.Errors, err)
+		return nil, err
 	}
 
-	// TODO: Remove InsecureSkipVerify
-	c.TLSConfig = &tls.Config{
-		// RootCAs:    certPool,
-		Certificates:       []tls.Certificate{cert},
-		ServerName:         serverName,
-		InsecureSkipVerify: false, // ONLY FOR TESTING - NEVER IN PRODUCTION
+	rootCAs, err := pki.LoadCertPool(caPath)
+	if err != nil {
+		return nil, err
 	}
 
-	return c
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
 // Connect to the server, using the provided address and port in the
@@ -181,24 +330,248 @@ func (c *TcpClient) Configure(certPath, keyPath, serverName string) *TcpClient {
 // will be secured using the TLS configuration provided.
 //
 // To use TLS the client must be configured using the client.Configure
-// function, otherwise the connection will not be secured.
+// function, otherwise the connection will fail.
+//
+// Once connected, the handshake is completed before this function returns,
+// so the connection is ready to be used to authenticate. If the handshake
+// fails, the connection is closed and nil is returned.
 //
 // The connection object is returned and can be used by the caller. The caller
 // owns the memory and is responsible for closing the connection.
 func (c *TcpClient) Connect() net.Conn {
+	conn, err := c.ConnectContext(context.Background())
+	if err != nil {
+		c.Errors = append(c.Errors, err)
+		return nil
+	}
+	return conn
+}
+
+// ConnectContext connects to the server and completes the handshake, like
+// Connect, but the error is returned to the caller instead of being added to
+// the client's error slice. The context limits how long connecting and the
+// handshake may take, it has no effect once the connection is returned.
+func (c *TcpClient) ConnectContext(ctx context.Context) (net.Conn, error) {
+	addr := net.JoinHostPort(c.Opts.Addr, strconv.Itoa(c.Opts.Port))
+
 	var conn net.Conn
 	var err error
-
-	if c.Opts.TLS && c.TLSConfig != nil {
-		conn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", c.Opts.Addr, c.Opts.Port), c.TLSConfig)
+	if c.Opts.UnixSocket != "" {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "unix", c.Opts.UnixSocket)
+	} else if c.Opts.TLS {
+		if c.TLSConfig == nil {
+			return nil, errors.New("TLS is enabled but the client has not been configured")
+		}
+		dialer := &tls.Dialer{Config: c.TLSConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
 	} else {
-		conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", c.Opts.Addr, c.Opts.Port))
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
 	}
 
 	if err != nil {
-		c.Errors = append(c.Errors, err)
+		return nil, err
+	}
+
+	if c.Opts.WebSocketPath != "" {
+		if conn, err = c.upgrade(ctx, conn, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	// Wrap the connection so events can be read and written as frames.
+	wc := wire.NewConn(conn, c.Opts.MsgBufSize)
+	wc.MaxFrameSize = c.Opts.MaxEventSize
+	wc.Stats = &c.Stats
+	if err := c.handshake(ctx, wc); err != nil {
+		wc.Close()
+		return nil, err
+	}
+
+	return wc, nil
+}
+
+// Upgrade the connection to a WebSocket connection. The connection is closed
+// if the upgrade fails.
+func (c *TcpClient) upgrade(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	deadline := time.Now().Add(handshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	ws, err := wire.DialWebSocket(conn, addr, c.Opts.WebSocketPath)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Complete the handshake with the server. The hello event is sent and the
+// response is read directly from the connection, as the read loop will not
+// have been started yet.
+//
+// The server may reject the connection before the handshake, such as when
+// it is full, in which case the rejection is returned as an error.
+func (c *TcpClient) handshake(ctx context.Context, conn *wire.Conn) error {
+	if err := c.Send(conn, events.NewHelloEvent(events.ProtocolVersion, c.Opts.Features)); err != nil {
+		return err
+	}
+
+	// Do not wait on the server forever, the deadline is cleared once
+	// the handshake is complete.
+	deadline := time.Now().Add(handshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Cancelling the context interrupts the read by moving the deadline.
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	event, err := frame.Decode()
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	switch e := event.(type) {
+	case *events.WelcomeEvent:
+		c.Version = e.Content.Version
+		c.Features = e.Content.Features
+		c.Logger.Log(fmt.Sprintf("Handshake completed: version %d, features %v\n", c.Version, c.Features), logger.DEBUG)
+
+		// Every event after the welcome is encoded with the negotiated codec,
+		// and compressed if it is large enough.
+		if c.HasFeature(events.FeatureBinary) {
+			conn.SetCodec(events.Binary)
+		}
+		if c.HasFeature(events.FeatureCompression) {
+			conn.EnableCompression(c.Opts.CompressionThreshold)
+		}
+		return nil
+	case *events.ErrorEvent:
+		return fmt.Errorf("handshake failed: %w", e)
+	case *events.ConnectionRejectedEvent:
+		return fmt.Errorf("connection rejected: %d %s", e.Content.Code, e.Content.Reason)
+	default:
+		return fmt.Errorf("handshake failed: unexpected event '%s'", e.(events.Event).Base().Event)
+	}
+}
+
+// Check if a feature was enabled during the handshake.
+func (c *TcpClient) HasFeature(feature string) bool {
+	return utils.Contains(c.Features, feature)
+}
+
+// Listen reads the events sent by the server and passes them to HandleEvent,
+// until the connection is closed. The connection must be the one returned by
+// the Connect function.
+//
+// This function blocks, so requests must be made from another goroutine. When
+// the connection is closed, nil is returned, otherwise the error which stopped
+// the loop is returned.
+func (c *TcpClient) Listen(conn net.Conn) error {
+	return c.readEvents(wire.Wrap(conn), func(event interface{}) bool {
+		c.HandleEvent(event)
+		return true
+	})
+}
+
+// Events runs the read loop in a new goroutine, and returns a channel which
+// receives the events sent by the server. This allows a program to select on
+// the events alongside its own work, instead of registering handlers.
+//
+// Registered handlers are still run for each event, and responses to pending
+// requests are still delivered to Request, but responses are not sent on the
+// channel. The channel is unbuffered, the next event is not read from the
+// connection until the current one has been received. This pushes back on the
+// server, which applies its queue policy to clients which fall behind. Requests
+// wait on the read loop, so they will not complete while the channel is not
+// being received from.
+//
+// The channel is closed when the connection is closed or the context is
+// cancelled. Cancelling the context may leave part of an event unread, so the
+// connection should be closed afterwards. Errors which stop the read loop are
+// added to the client's error slice before the channel is closed.
+func (c *TcpClient) Events(ctx context.Context, conn net.Conn) <-chan events.Event {
+	ch := make(chan events.Event)
+	wc := wire.Wrap(conn)
+
+	// Cancelling the context interrupts the read by moving the deadline.
+	stop := context.AfterFunc(ctx, func() { wc.SetReadDeadline(time.Now()) })
+
+	go func() {
+		defer close(ch)
+		defer stop()
+
+		err := c.readEvents(wc, func(event interface{}) bool {
+			c.runHandler(event)
+			if c.resolve(event) {
+				return true
+			}
+
+			e, ok := event.(events.Event)
+			if !ok {
+				return true
+			}
+			select {
+			case ch <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+
+		if err != nil && ctx.Err() == nil {
+			c.Errors = append(c.Errors, err)
+			c.Logger.Log(fmt.Sprintf("Error reading from connection: %v\n", err), logger.ERROR)
+		}
+	}()
+
+	return ch
+}
+
+// Read the events sent by the server and pass them to the handle function,
+// until the connection is closed or the function returns false. When the
+// connection is closed, nil is returned.
+func (c *TcpClient) readEvents(wc *wire.Conn, handle func(event interface{}) bool) error {
+	for {
+		frame, err := wc.ReadFrame()
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+			// Connection closed, can exit safely
+			return nil
+		} else if errors.Is(err, wire.ErrFrameTooLarge) {
+			// The event was discarded, the next event can still be read.
+			c.Logger.Log(fmt.Sprintf("Error reading from connection: %v\n", err), logger.ERROR)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Print the message to the client's logger, for debugging purposes.
+		c.Logger.Log(fmt.Sprintf("%s\n", frame), logger.DEBUG)
+
+		event, err := frame.Decode()
+		if err != nil {
+			// This happens when an event that is not implemented is received.
+			c.Logger.Log(fmt.Sprintf("Error parsing message: %v\n", err), logger.ERROR)
+			continue
+		}
+
+		if !handle(event) {
+			return nil
+		}
 	}
-	return conn
 }
 
 // This function is used to close the connection to the server.
@@ -210,21 +583,123 @@ func (c *TcpClient) Connect() net.Conn {
 func (c *TcpClient) Disconnect(conn net.Conn) {
 	defer conn.Close()
 
-	bytes, err := json.Marshal(events.NewClientDisconnectingEvent(c.ID))
-	if err != nil {
+	c.Logger.Log(fmt.Sprintf("Disconnecting from server: %s\n", c.ID), logger.DEBUG)
+	if err := c.Send(conn, events.NewClientDisconnectingEvent(c.ID)); err != nil {
 		c.Errors = append(c.Errors, err)
-		c.Logger.Log(fmt.Sprintf("Error marshaling disconnect event: %v", err), logger.ERROR) // Log the error!
-		return                                                                                // Important: Return early if marshaling fails!
+		c.Logger.Log(fmt.Sprintf("Error sending disconnect event: %v\n", err), logger.ERROR)
+	}
+}
+
+// Send encodes the event and writes it to the server as a frame, using the codec
+// negotiated during the handshake. This does not wait for a response, use the
+// Request method if a response is expected.
+//
+// Unlike most methods on the TcpClient, the error is returned to the caller
+// instead of being added to the client's error slice.
+func (c *TcpClient) Send(conn net.Conn, event interface{}) error {
+	return wire.Wrap(conn).WriteEvent(event)
+}
+
+// Request sends an event to the server and waits for the correlated response.
+// A request ID is generated and stored in the event, the server will copy the
+// ID into its response which is how the response is matched to the request.
+//
+// The response is delivered by HandleEvent, so the read loop must be running
+// in another goroutine, and this function must never be called from within an
+// event handler or it will wait forever. The context should have a deadline.
+//
+// Events which are only answered with an ack, such as sending a message, will
+// never receive a response unless acks were enabled during the handshake.
+//
+// If the server responds with an ErrorEvent, it is returned as the error. The
+// response event is returned as an interface{} and will need to be asserted to
+// the correct type, like the events returned by the Parser.
+func (c *TcpClient) Request(ctx context.Context, conn net.Conn, event events.Event) (interface{}, error) {
+	requestID := utils.GenerateRequestID()
+	event.Base().RequestID = requestID
+
+	// The channel is buffered so HandleEvent never blocks on a request
+	// which has already been abandoned.
+	response := make(chan interface{}, 1)
+	c.mu.Lock()
+	c.pending[requestID] = response
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, requestID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.Send(conn, event); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-response:
+		if errEvent, ok := res.(*events.ErrorEvent); ok {
+			return nil, errEvent
+		}
+		return res, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request '%s' (%s) failed: %w", event.Base().Event, requestID, ctx.Err())
 	}
-	c.Logger.Log(fmt.Sprintf("Disconnecting from server: %s\n", c.ID), logger.DEBUG)
-	conn.Write(bytes)
+}
+
+// Deliver the event to the request waiting on it, if there is one. Returns
+// true if the event was a response to a pending request.
+func (c *TcpClient) resolve(event interface{}) bool {
+	e, ok := event.(events.Event)
+	if !ok || e.Base().RequestID == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	response, ok := c.pending[e.Base().RequestID]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	response <- event
+	return true
 }
 
 // Use the notify package to send a notification to the client's
 // desktop. This function is only used by the client, as the server
 // has no GUI or reason to have a UI/UX.
+//
+// Nothing is shown while do not disturb is enabled, the messages are
+// still stored in the inbox.
 func (c *TcpClient) Notify(title, message string) {
+	if c.doNotDisturb.Load() {
+		c.Logger.Log(fmt.Sprintf("Do not disturb is enabled, notification hidden: %s\n", title), logger.DEBUG)
+		return
+	}
 	if err := notify.Notify(title, message); err != nil {
 		c.Logger.Log(fmt.Sprintf("Error sending notification: %v", err), logger.ERROR)
 	}
 }
+
+// SetDoNotDisturb pauses or resumes the desktop notifications.
+func (c *TcpClient) SetDoNotDisturb(enabled bool) {
+	c.doNotDisturb.Store(enabled)
+}
+
+// DoNotDisturb reports whether the desktop notifications are paused.
+func (c *TcpClient) DoNotDisturb() bool {
+	return c.doNotDisturb.Load()
+}
+
+// Recent returns up to limit of the most recent messages in the inbox, newest
+// first. When limit is zero every message is returned, and when unread is set
+// only the messages which have not been read are returned.
+func (c *TcpClient) Recent(limit int, unread bool) []InboxMessage {
+	return c.inbox.recent(limit, unread)
+}
+
+// MarkRead marks the messages in the inbox with the IDs as read, or every
+// message when no IDs are provided. Returns the number of messages marked.
+func (c *TcpClient) MarkRead(ids ...uint64) int {
+	return c.inbox.markRead(ids...)
+}
@@ -24,10 +24,11 @@ func ConnectionAcceptedHandler(client *TcpClient, event *events.ConnectionAccept
 //
 // TODO: Implement UI features here.
 func ClientAuthenticatedHandler(client *TcpClient, event *events.ClientAuthenticatedEvent) {
-	msg := fmt.Sprintf("New client authenticated: %s\n", event.Content.ClientID)
+	name := displayName(event.Content.ClientID, event.Content.Device)
+	msg := fmt.Sprintf("New client authenticated: %s\n", name)
 	client.Logger.Log(msg, logger.INFO)
 
-	client.Notify("Gophernest", fmt.Sprintf("Client authenticated: %s", event.Content.ClientID))
+	client.Notify("Gophernest", fmt.Sprintf("Client authenticated: %s", name))
 }
 
 // Handle the ClientDisconnectedEvent sent by the server to the client. This
@@ -36,10 +37,20 @@ func ClientAuthenticatedHandler(client *TcpClient, event *events.ClientAuthentic
 //
 // TODO: Implement UI features here.
 func ClientDisconnectedHandler(client *TcpClient, event *events.ClientDisconnectedEvent) {
-	msg := fmt.Sprintf("Client disconnected: %s\n", event.Content.ClientID)
+	name := displayName(event.Content.ClientID, event.Content.Device)
+	msg := fmt.Sprintf("Client disconnected: %s\n", name)
 	client.Logger.Log(msg, logger.INFO)
 
-	client.Notify("Gophernest", fmt.Sprintf("Client disconnected: %s", event.Content.ClientID))
+	client.Notify("Gophernest", fmt.Sprintf("Client disconnected: %s", name))
+}
+
+// Get the name to display for another client. The device name is used when
+// the server provides one, otherwise the client ID is used.
+func displayName(clientID, device string) string {
+	if device == "" {
+		return clientID
+	}
+	return device
 }
 
 // Handle the BroadcastMessageEvent sent by the server to the client. This
@@ -51,5 +62,41 @@ func BroadcastMessageHandler(client *TcpClient, event *events.BroadcastMessageEv
 	msg := fmt.Sprintf("(%s): %s\n", event.Content.Sender, event.Content.Message)
 	client.Logger.Log(msg, logger.INFO)
 
-	client.Notify(fmt.Sprintf("Gophernest: %s", event.Content.Sender), event.Content.Message)
+	// Store the message so local tools can list it over the IPC socket.
+	client.inbox.add(event)
+
+	// The title is shown in place of the sender when one is provided.
+	title := event.Content.Sender
+	if event.Content.Title != "" {
+		title = event.Content.Title
+	}
+	client.Notify(fmt.Sprintf("Gophernest: %s", title), event.Content.Message)
+}
+
+// Handle the ErrorEvent sent by the server to the client. This event is sent
+// when the server could not handle an event sent by this client. The error
+// is logged along with the event which caused it.
+func ErrorHandler(client *TcpClient, event *events.ErrorEvent) {
+	msg := fmt.Sprintf("Server returned %d %s for '%s': %s\n", event.Content.Code, events.CodeText(event.Content.Code), event.Content.RequestEvent, event.Content.Reason)
+	client.Logger.Log(msg, logger.ERROR)
+}
+
+// Handle the AckEvent sent by the server to the client. This event is sent
+// in response to a request which has no other response, the ack itself is
+// delivered to the caller of Request, so this only prints debug messages.
+func AckHandler(client *TcpClient, event *events.AckEvent) {
+	msg := fmt.Sprintf("Server acknowledged '%s', delivered to %d client(s)\n", event.Content.RequestEvent, event.Content.Delivered)
+	client.Logger.Log(msg, logger.DEBUG)
+}
+
+// Handle the ServerShuttingDownEvent sent by the server to the client. This
+// event is sent when the server is shutting down, the connection will be
+// closed by the server once the remaining events have been sent.
+//
+// TODO: Reconnect automatically once the hinted time has passed.
+func ServerShuttingDownHandler(client *TcpClient, event *events.ServerShuttingDownEvent) {
+	msg := fmt.Sprintf("Server is shutting down, reconnect in %d second(s): %s\n", event.Content.ReconnectAfter, event.Content.Reason)
+	client.Logger.Log(msg, logger.WARN)
+
+	client.Notify("Gophernest", fmt.Sprintf("Server is shutting down, reconnect in %d second(s)", event.Content.ReconnectAfter))
 }
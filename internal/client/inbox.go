@@ -0,0 +1,118 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+)
+
+// InboxMessage is a message broadcast by the server and stored by the client,
+// so local tools can list the recent messages and mark them as read.
+type InboxMessage struct {
+	// ID of the message in the inbox. IDs are assigned in the order the
+	// messages are received, and are never reused while the client runs.
+	ID uint64 `json:"id"`
+
+	Sender    string    `json:"sender"`
+	Message   string    `json:"message"`
+	Title     string    `json:"title,omitempty"`
+	Topic     string    `json:"topic,omitempty"`
+	Priority  string    `json:"priority,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	Read bool `json:"read"`
+}
+
+// The most recent messages received by the client. Once the inbox is full,
+// the oldest message is dropped to make room for each new message.
+type inbox struct {
+	mu       sync.Mutex
+	messages []InboxMessage
+	size     int
+	nextID   uint64
+}
+
+// Create an inbox which holds up to size messages.
+func newInbox(size int) *inbox {
+	return &inbox{size: size, nextID: 1}
+}
+
+// Store a broadcast message in the inbox, it is unread until marked otherwise.
+func (i *inbox) add(event *events.BroadcastMessageEvent) InboxMessage {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	msg := InboxMessage{
+		ID:        i.nextID,
+		Sender:    event.Content.Sender,
+		Message:   event.Content.Message,
+		Title:     event.Content.Title,
+		Topic:     event.Content.Topic,
+		Priority:  event.Content.Priority,
+		Timestamp: event.Timestamp,
+	}
+	i.nextID++
+
+	if i.size <= 0 {
+		return msg
+	}
+	if len(i.messages) >= i.size {
+		i.messages = i.messages[len(i.messages)-i.size+1:]
+	}
+	i.messages = append(i.messages, msg)
+	return msg
+}
+
+// Get up to limit of the most recent messages, newest first. When limit is
+// zero every message is returned, and when unread is set the messages which
+// have been read are skipped.
+func (i *inbox) recent(limit int, unread bool) []InboxMessage {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	messages := []InboxMessage{}
+	for n := len(i.messages) - 1; n >= 0; n-- {
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+		if unread && i.messages[n].Read {
+			continue
+		}
+		messages = append(messages, i.messages[n])
+	}
+	return messages
+}
+
+// Mark the messages with the IDs as read, or every message when no IDs are
+// provided. Returns the number of messages which were unread.
+func (i *inbox) markRead(ids ...uint64) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	marked := 0
+	for n := range i.messages {
+		msg := &i.messages[n]
+		if msg.Read || (len(ids) > 0 && !utils.Contains(ids, msg.ID)) {
+			continue
+		}
+		msg.Read = true
+		marked++
+	}
+	return marked
+}
+
+// Count the messages in the inbox which have not been read.
+func (i *inbox) unread() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	count := 0
+	for _, msg := range i.messages {
+		if !msg.Read {
+			count++
+		}
+	}
+	return count
+}
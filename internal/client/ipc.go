@@ -0,0 +1,305 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+)
+
+// Other programs on the desktop talk to the client over a local Unix socket,
+// so they can publish and read notifications through the client's connection
+// instead of opening their own. Each request is a JSON object on its own line,
+// and the client writes one JSON response line for each request:
+//
+//	$ echo '{"command": "publish", "message": "Build finished"}' | nc -U tnm-client.sock
+//	{"ok":true,"result":{"delivered":2}}
+//
+// Any number of requests can be sent on a connection, they are handled in
+// order. Only the users which can write to the socket are able to connect,
+// by default this is only the user running the client.
+
+// Commands accepted over the IPC socket.
+const (
+	// Publish a message through the client's connection to the server.
+	IPCPublish = "publish"
+
+	// List the recent messages in the inbox, newest first.
+	IPCRecent = "recent"
+
+	// Mark messages in the inbox as read.
+	IPCMarkRead = "mark_read"
+
+	// Enable, disable or check do not disturb.
+	IPCDoNotDisturb = "dnd"
+
+	// Get the state of the client.
+	IPCStatus = "status"
+)
+
+// Time allowed to publish a message before the request fails.
+const ipcPublishTimeout = 10 * time.Second
+
+// IPCRequest is a request sent to the client over the IPC socket. Only the
+// fields used by the command need to be set.
+type IPCRequest struct {
+	Command string `json:"command"`
+
+	// Message to publish, along with its optional title, topic and
+	// priority.
+	Message  string `json:"message,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Priority string `json:"priority,omitempty"`
+
+	// Max number of recent messages to list, every message when zero,
+	// and whether to only list the unread messages.
+	Limit  int  `json:"limit,omitempty"`
+	Unread bool `json:"unread,omitempty"`
+
+	// Messages to mark as read, every message when empty.
+	IDs []uint64 `json:"ids,omitempty"`
+
+	// Enable or disable do not disturb. When not set, the current state
+	// is returned without changing it.
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// IPCResponse is the response to a request sent over the IPC socket. When the
+// request fails, OK is false and the error is set, in the same format as the
+// error event sent by the server.
+type IPCResponse struct {
+	OK     bool        `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *IPCError   `json:"error,omitempty"`
+}
+
+// IPCError describes why a request sent over the IPC socket failed.
+type IPCError struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Result of the publish command. Delivered is only set when acks have been
+// enabled for the connection, otherwise the server does not report it.
+type IPCPublishResult struct {
+	Delivered *int `json:"delivered,omitempty"`
+}
+
+// Result of the recent command.
+type IPCRecentResult struct {
+	Messages []InboxMessage `json:"messages"`
+}
+
+// Result of the mark_read command.
+type IPCMarkReadResult struct {
+	Marked int `json:"marked"`
+}
+
+// Result of the dnd command.
+type IPCDoNotDisturbResult struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Result of the status command.
+type IPCStatusResult struct {
+	ClientID     string `json:"client_id"`
+	Unread       int    `json:"unread"`
+	DoNotDisturb bool   `json:"dnd"`
+}
+
+// DefaultIPCSocket returns the default path of the IPC socket. The socket is
+// created in the runtime directory of the user when there is one, otherwise
+// in the temporary directory, named after the user so users do not collide.
+func DefaultIPCSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tnm-client.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tnm-client-%d.sock", os.Getuid()))
+}
+
+// ServeIPC accepts requests from other programs on the IPC socket in the client
+// options, until the context is cancelled. Messages are published over conn,
+// so the read loop must be running in another goroutine, see Request.
+//
+// A socket left behind by a client which did not shut down cleanly is removed,
+// the socket is removed again once the context is cancelled. Returns nil once
+// every request in progress has finished after the context is cancelled.
+func (c *TcpClient) ServeIPC(ctx context.Context, conn net.Conn) error {
+	if c.Opts.IPCSocket == "" {
+		return errors.New("the IPC socket has not been provided in the client options")
+	}
+
+	ln, err := listenIPC(c.Opts.IPCSocket, c.Opts.IPCSocketMode)
+	if err != nil {
+		return err
+	}
+	c.Logger.Log(fmt.Sprintf("Accepting local requests on %s\n", c.Opts.IPCSocket))
+
+	// Closing the listener stops the accept loop, and each connection is
+	// closed along with it so the handlers stop waiting on their reads.
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		ipcConn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			ln.Close()
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopConn := context.AfterFunc(ctx, func() { ipcConn.Close() })
+			defer stopConn()
+			c.handleIPC(ctx, conn, ipcConn)
+		}()
+	}
+}
+
+// Listen on the Unix socket at the path with the permissions. A socket left
+// behind at the path is removed, any other file is left alone.
+func listenIPC(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("cannot listen on %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Read the requests sent on an IPC connection and write the response to each,
+// until the connection is closed. Requests larger than the max event size are
+// rejected and the connection is closed.
+func (c *TcpClient) handleIPC(ctx context.Context, conn net.Conn, ipcConn net.Conn) {
+	defer ipcConn.Close()
+
+	scanner := bufio.NewScanner(ipcConn)
+	scanner.Buffer(make([]byte, 0, c.Opts.MsgBufSize), c.Opts.MaxEventSize)
+	encoder := json.NewEncoder(ipcConn)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var req IPCRequest
+		var res IPCResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			res = ipcError(events.CodeBadRequest, fmt.Sprintf("Malformed Request: %s", err))
+		} else {
+			res = c.handleIPCRequest(ctx, conn, req)
+		}
+
+		if err := encoder.Encode(res); err != nil {
+			return
+		}
+	}
+
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		encoder.Encode(ipcError(events.CodePayloadTooLarge, fmt.Sprintf("Payload Too Large: Request exceeds the max event size of %d bytes", c.Opts.MaxEventSize)))
+	}
+}
+
+// Handle a single request sent over the IPC socket.
+func (c *TcpClient) handleIPCRequest(ctx context.Context, conn net.Conn, req IPCRequest) IPCResponse {
+	switch req.Command {
+	case IPCPublish:
+		return c.ipcPublish(ctx, conn, req)
+
+	case IPCRecent:
+		return IPCResponse{OK: true, Result: IPCRecentResult{Messages: c.Recent(req.Limit, req.Unread)}}
+
+	case IPCMarkRead:
+		return IPCResponse{OK: true, Result: IPCMarkReadResult{Marked: c.MarkRead(req.IDs...)}}
+
+	case IPCDoNotDisturb:
+		if req.Enabled != nil {
+			c.SetDoNotDisturb(*req.Enabled)
+			c.Logger.Log(fmt.Sprintf("Do not disturb set to %t over IPC\n", *req.Enabled), logger.DEBUG)
+		}
+		return IPCResponse{OK: true, Result: IPCDoNotDisturbResult{Enabled: c.DoNotDisturb()}}
+
+	case IPCStatus:
+		return IPCResponse{OK: true, Result: IPCStatusResult{
+			ClientID:     c.ID,
+			Unread:       c.inbox.unread(),
+			DoNotDisturb: c.DoNotDisturb(),
+		}}
+
+	default:
+		return ipcError(events.CodeNotImplemented, fmt.Sprintf("Unknown Command: '%s' is not a command", req.Command))
+	}
+}
+
+// Publish a message through the client's connection to the server. When acks
+// are enabled, the response is sent once the server has broadcast the message
+// and includes the number of clients it was delivered to.
+func (c *TcpClient) ipcPublish(ctx context.Context, conn net.Conn, req IPCRequest) IPCResponse {
+	if req.Message == "" {
+		return ipcError(events.CodeBadRequest, "Missing Message: The message field is required")
+	}
+
+	msg := events.NewSendMessageEvent(c.ID, req.Message)
+	msg.Content.Title = req.Title
+	msg.Content.Topic = req.Topic
+	msg.Content.Priority = req.Priority
+
+	if !c.HasFeature(events.FeatureAcks) {
+		if err := c.Send(conn, msg); err != nil {
+			return ipcError(events.CodeServiceUnavailable, fmt.Sprintf("Not Connected: %s", err))
+		}
+		return IPCResponse{OK: true, Result: IPCPublishResult{}}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ipcPublishTimeout)
+	defer cancel()
+
+	res, err := c.Request(ctx, conn, &msg)
+	var errEvent *events.ErrorEvent
+	if errors.As(err, &errEvent) {
+		return ipcError(errEvent.Content.Code, errEvent.Content.Reason)
+	} else if err != nil {
+		return ipcError(events.CodeServiceUnavailable, fmt.Sprintf("Not Connected: %s", err))
+	}
+
+	result := IPCPublishResult{}
+	if ack, ok := res.(*events.AckEvent); ok {
+		result.Delivered = &ack.Content.Delivered
+	}
+	return IPCResponse{OK: true, Result: result}
+}
+
+// Create the response to a failed request.
+func ipcError(code int, reason string) IPCResponse {
+	return IPCResponse{Error: &IPCError{Code: code, Reason: reason}}
+}
@@ -12,8 +12,8 @@ import (
 // Very similar to how the server parses the events, but had to be abstracted here to
 // keep the client code clean and easy to read.
 //
-// msg should be a byte slice that is sent from the server to the client. If the message
-// is not a valid event, then an error will be thrown.
+// msg should be a JSON encoded event that is sent from the server to the client. If the
+// message is not a valid event, then an error will be thrown.
 func (c *TcpClient) HandleMessage(msg []byte) {
 	// Print the message to the client's logger, for debugging purposes.
 	c.Logger.Log(string(msg)+"\n", logger.DEBUG)
@@ -25,6 +25,26 @@ func (c *TcpClient) HandleMessage(msg []byte) {
 		return
 	}
 
+	c.HandleEvent(event)
+}
+
+// HandleEvent runs the event handler registered for an event which has already
+// been parsed, then delivers the event to the request waiting on it, if there
+// is one. The event should be one of the pointers returned by the Parser.
+func (c *TcpClient) HandleEvent(event interface{}) {
+	if !c.runHandler(event) {
+		c.Logger.Log(fmt.Sprintln("No handler found for", reflect.TypeOf(event).Elem().Name()), logger.ERROR)
+	}
+
+	// Once the handlers have run, the event is passed to the request waiting
+	// on it, if there is one. This is done last so the client state has been
+	// updated by the handlers before the caller of Request continues.
+	c.resolve(event)
+}
+
+// Run the event handler registered for the event. Returns false if there is
+// no handler registered for the event.
+func (c *TcpClient) runHandler(event interface{}) bool {
 	// This next section was copied from the server's HandleConnection method, it is
 	// very hard to read and understand, but it makes the event creation and handling
 	// pretty simple.
@@ -52,7 +72,7 @@ func (c *TcpClient) HandleMessage(msg []byte) {
 		} else {
 			c.Logger.Log(fmt.Sprintln("Handler type mismatch for", eventName), logger.ERROR)
 		}
-	} else {
-		c.Logger.Log(fmt.Sprintln("No handler found for", eventName), logger.ERROR)
+		return true
 	}
+	return false
 }
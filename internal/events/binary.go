@@ -0,0 +1,349 @@
+package events
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Encodes the events in a compact binary format. The format is much smaller
+// than JSON, as field names are not included and the timestamps are stored
+// as integers instead of strings.
+//
+// The fields of a struct are written in the order they are defined, with no
+// names or tags, so both sides must use the same version of the structs. This
+// is guaranteed by the protocol version negotiated in the handshake. The base
+// event is always the first field of an event, so it can be decoded without
+// knowing the type of the event.
+//
+// The values are encoded as follows:
+//   - strings and byte slices: uvarint length followed by the bytes
+//   - signed integers: zig-zag varint
+//   - unsigned integers: uvarint
+//   - floats: 8 bytes, big endian IEEE 754
+//   - bools: a single byte, 0 or 1
+//   - time.Time: varint unix seconds followed by uvarint nanoseconds, in UTC
+//   - slices: uvarint length followed by each element
+//   - maps: uvarint length followed by each key and value, string keys are sorted
+//   - pointers: a single byte, 0 for nil or 1 followed by the value
+//   - structs: each exported field in order, embedded structs are inlined
+//
+// Nil and empty slices and maps have the same encoding, they are both decoded
+// as nil, which is how JSON decodes the nil slices and maps sent as null.
+type binaryCodec struct{}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+
+	errBinaryTruncated = errors.New("binary event is truncated")
+)
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(event interface{}) ([]byte, error) {
+	v := reflect.ValueOf(event)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, errors.New("cannot encode a nil event")
+		}
+		v = v.Elem()
+	}
+
+	return appendBinary(make([]byte, 0, 128), v)
+}
+
+func (binaryCodec) Unmarshal(data []byte, event interface{}) error {
+	v := reflect.ValueOf(event)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return errors.New("cannot decode into a non-pointer")
+	}
+
+	d := &binaryDecoder{data: data}
+	if err := d.decode(v.Elem()); err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return fmt.Errorf("binary event has %d trailing bytes", len(d.data)-d.off)
+	}
+	return nil
+}
+
+func (binaryCodec) UnmarshalBase(data []byte) (BaseEvent, error) {
+	// The rest of the event is ignored, so trailing data is expected here.
+	var base BaseEvent
+	d := &binaryDecoder{data: data}
+	if err := d.decode(reflect.ValueOf(&base).Elem()); err != nil {
+		return BaseEvent{}, err
+	}
+	return base, nil
+}
+
+// Check if the field of a struct should be encoded. Unexported fields and
+// fields ignored by the JSON codec are skipped, so both codecs carry the
+// same data.
+func binaryField(field reflect.StructField) bool {
+	if !field.IsExported() {
+		return false
+	}
+	return field.Tag.Get("json") != "-"
+}
+
+// Append the binary encoding of the value to the buffer.
+func appendBinary(buf []byte, v reflect.Value) ([]byte, error) {
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		buf = binary.AppendVarint(buf, t.Unix())
+		return binary.AppendUvarint(buf, uint64(t.Nanosecond())), nil
+	}
+
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		buf = append(buf, v.String()...)
+	case reflect.Bool:
+		if v.Bool() {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf = binary.AppendVarint(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf = binary.AppendUvarint(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v.Float()))
+	case reflect.Slice:
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(buf, v.Bytes()...), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if buf, err = appendBinary(buf, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		// Keys are sorted so the same map always has the same encoding.
+		keys := v.MapKeys()
+		if v.Type().Key().Kind() == reflect.String {
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(len(keys)))
+		for _, key := range keys {
+			if buf, err = appendBinary(buf, key); err != nil {
+				return nil, err
+			}
+			if buf, err = appendBinary(buf, v.MapIndex(key)); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			return append(buf, 0), nil
+		}
+		buf = append(buf, 1)
+		return appendBinary(buf, v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !binaryField(v.Type().Field(i)) {
+				continue
+			}
+			if buf, err = appendBinary(buf, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("cannot encode %s as binary", v.Type())
+	}
+
+	return buf, nil
+}
+
+// Reads the values from the data in the same order they were written by
+// appendBinary. Every read is bounds checked, so malformed data returns an
+// error instead of panicking or allocating huge buffers.
+type binaryDecoder struct {
+	data []byte
+	off  int
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(d.data[d.off:])
+	if size <= 0 {
+		return 0, errBinaryTruncated
+	}
+	d.off += size
+	return n, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	n, size := binary.Varint(d.data[d.off:])
+	if size <= 0 {
+		return 0, errBinaryTruncated
+	}
+	d.off += size
+	return n, nil
+}
+
+// Read a length prefix, which can never be larger than the remaining data
+// as every element takes at least one byte.
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.off) {
+		return 0, errBinaryTruncated
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) bytes(n int) ([]byte, error) {
+	if n > len(d.data)-d.off {
+		return nil, errBinaryTruncated
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *binaryDecoder) decode(v reflect.Value) error {
+	if v.Type() == timeType {
+		sec, err := d.varint()
+		if err != nil {
+			return err
+		}
+		nsec, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(time.Unix(sec, int64(nsec)).UTC()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		b, err := d.bytes(n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Bool:
+		b, err := d.bytes(1)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := d.varint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("value %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("value %d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		b, err := d.bytes(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case reflect.Slice:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes(n)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Map:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+	case reflect.Pointer:
+		b, err := d.bytes(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := d.decode(elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !binaryField(v.Type().Field(i)) {
+				continue
+			}
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot decode %s from binary", v.Type())
+	}
+
+	return nil
+}
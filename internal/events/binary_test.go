@@ -0,0 +1,150 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Every event the protocol defines, built with its constructor. The variants
+// cover empty strings, nil slices, and the optional fields added to the end of
+// the content after the binary codec. Empty slices are not included, the binary
+// codec decodes them as nil while JSON does not.
+func roundTripEvents() map[string]Event {
+	request := BaseEvent{Event: "send_message", ID: "client-1", RequestID: "req-1", Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+
+	hello := NewHelloEvent(ProtocolVersion, []string{FeatureAcks})
+	helloNil := NewHelloEvent(ProtocolVersion, nil)
+	welcome := NewWelcomeEvent("server-1", ProtocolVersion, []string{FeatureAcks})
+	welcomeNil := NewWelcomeEvent("", 0, nil)
+	accepted := NewConnectionAcceptedEvent("server-1", "client-1")
+	acceptedEmpty := NewConnectionAcceptedEvent("", "")
+	rejected := NewConnectionRejectedEvent("server-1", CodeVersionNotSupported, "Unsupported Protocol: Upgrade the client")
+	auth := NewRequestAuthenticationEvent("token")
+	authEmpty := NewRequestAuthenticationEvent("")
+	authenticated := NewClientAuthenticatedEvent("server-1", "client-1", "laptop")
+	authenticatedNoDevice := NewClientAuthenticatedEvent("server-1", "client-1", "")
+	disconnecting := NewClientDisconnectingEvent("client-1")
+	disconnected := NewClientDisconnectedEvent("server-1", "client-1", "laptop")
+	disconnectedNoDevice := NewClientDisconnectedEvent("server-1", "client-1", "")
+	send := NewSendMessageEvent("client-1", "Backup finished")
+	send.RequestID = "req-1"
+	send.Content.Title = "Backups"
+	send.Content.Topic = "cron"
+	send.Content.Priority = PriorityHigh
+	sendEmpty := NewSendMessageEvent("", "")
+	broadcast := NewBroadcastMessageEvent("server-1", "client-1", "Backup finished")
+	broadcast.Content.Title = "Backups"
+	broadcast.Content.Topic = "cron"
+	broadcast.Content.Priority = PriorityUrgent
+	broadcastEmpty := NewBroadcastMessageEvent("server-1", "client-1", "")
+	errorEvent := NewErrorEvent("server-1", CodeBadRequest, "Malformed Event: Event could not be parsed", request)
+	errorNoRequest := NewErrorEvent("server-1", CodeInternalError, "", BaseEvent{})
+	ack := NewAckEvent("server-1", "send_message", 3)
+	ackZero := NewAckEvent("server-1", "", 0)
+	shutdown := NewServerShuttingDownEvent("server-1", "Server is restarting", 1500*time.Millisecond)
+	kick := NewKickClientEvent("admin-1", "client-1")
+	heartbeat := NewHeartbeatEvent("client-1", "nightly-backup")
+	heartbeatEmpty := NewHeartbeatEvent("client-1", "")
+
+	return map[string]Event{
+		"hello":                          &hello,
+		"hello nil features":             &helloNil,
+		"welcome":                        &welcome,
+		"welcome nil features":           &welcomeNil,
+		"connection accepted":            &accepted,
+		"connection accepted empty":      &acceptedEmpty,
+		"connection rejected":            &rejected,
+		"request authentication":         &auth,
+		"request authentication empty":   &authEmpty,
+		"client authenticated":           &authenticated,
+		"client authenticated no device": &authenticatedNoDevice,
+		"client disconnecting":           &disconnecting,
+		"client disconnected":            &disconnected,
+		"client disconnected no device":  &disconnectedNoDevice,
+		"send message":                   &send,
+		"send message empty":             &sendEmpty,
+		"broadcast message":              &broadcast,
+		"broadcast message empty":        &broadcastEmpty,
+		"error":                          &errorEvent,
+		"error without request":          &errorNoRequest,
+		"ack":                            &ack,
+		"ack zero":                       &ackZero,
+		"server shutting down":           &shutdown,
+		"kick client":                    &kick,
+		"heartbeat":                      &heartbeat,
+		"heartbeat empty":                &heartbeatEmpty,
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for name, event := range roundTripEvents() {
+		t.Run(name, func(t *testing.T) {
+			// The timestamps are fixed so the decoded events can be compared
+			// with the original, JSON does not keep the monotonic clock.
+			event.Base().Timestamp = time.Date(2024, 5, 1, 12, 30, 15, 123456789, time.UTC)
+
+			jsonData, err := JSON.Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			binaryData, err := Binary.Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fromJSON, err := ParseWith(JSON, jsonData)
+			if err != nil {
+				t.Fatalf("parsing JSON: %v", err)
+			}
+			fromBinary, err := ParseWith(Binary, binaryData)
+			if err != nil {
+				t.Fatalf("parsing binary: %v", err)
+			}
+
+			if !reflect.DeepEqual(fromJSON, fromBinary) {
+				t.Errorf("codecs decoded different events\njson:   %+v\nbinary: %+v", fromJSON, fromBinary)
+			}
+			if !reflect.DeepEqual(fromBinary, event) {
+				t.Errorf("binary round trip changed the event\ngot:  %+v\nwant: %+v", fromBinary, event)
+			}
+		})
+	}
+}
+
+func TestCodecRoundTripBase(t *testing.T) {
+	for name, event := range roundTripEvents() {
+		t.Run(name, func(t *testing.T) {
+			event.Base().RequestID = "req-42"
+
+			jsonData, err := JSON.Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			binaryData, err := Binary.Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fromJSON, err := JSON.UnmarshalBase(jsonData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromBinary, err := Binary.UnmarshalBase(binaryData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !fromJSON.Timestamp.Equal(fromBinary.Timestamp) {
+				t.Errorf("got timestamps %s and %s", fromJSON.Timestamp, fromBinary.Timestamp)
+			}
+			fromJSON.Timestamp, fromBinary.Timestamp = time.Time{}, time.Time{}
+			if fromJSON != fromBinary {
+				t.Errorf("codecs decoded different bases\njson:   %+v\nbinary: %+v", fromJSON, fromBinary)
+			}
+			if fromBinary.RequestID != "req-42" || fromBinary.Event != event.Base().Event {
+				t.Errorf("got base %+v", fromBinary)
+			}
+		})
+	}
+}
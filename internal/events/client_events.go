@@ -2,6 +2,28 @@ package events
 
 import "time"
 
+// Create and return a new HelloEvent. This function does not generate any
+// details, instead it requires all details as arguments. Which should be
+// generated elsewhere.
+//
+// The version should almost always be the ProtocolVersion constant, and the
+// features are the optional features the client would like to enable.
+//
+// All timestamps will be sent back in UTC format.
+func NewHelloEvent(version int, features []string) HelloEvent {
+	return HelloEvent{
+		BaseEvent: BaseEvent{
+			Event:     "hello",
+			ID:        "",
+			Timestamp: time.Now().UTC(),
+		},
+		Content: HelloContent{
+			Version:  version,
+			Features: features,
+		},
+	}
+}
+
 // Create and return a new RequestAuthenticationEvent. This function does not
 // generate any details, instead it requires all details as arguments. Which
 // should be generated elsewhere.
@@ -65,3 +87,44 @@ func NewSendMessageEvent(clientID, message string) SendMessageEvent {
 		},
 	}
 }
+
+// Create and return a new KickClientEvent. This function does not generate
+// any details, instead it requires all details as arguments. Which should be
+// generated elsewhere.
+//
+// The client ID is the ID of the admin client sending the event, and the
+// target is the ID of the client to disconnect.
+//
+// All timestamps will be sent back in UTC format.
+func NewKickClientEvent(clientID, target string) KickClientEvent {
+	return KickClientEvent{
+		BaseEvent: BaseEvent{
+			Event:     "kick_client",
+			ID:        clientID,
+			Timestamp: time.Now().UTC(),
+		},
+		Content: KickClientContent{
+			ClientID: target,
+		},
+	}
+}
+
+// Create and return a new HeartbeatEvent. This function does not generate any
+// details, instead it requires all details as arguments. Which should be
+// generated elsewhere.
+//
+// The check is the name of the monitor on the server the heartbeat is for.
+//
+// All timestamps will be sent back in UTC format.
+func NewHeartbeatEvent(clientID, check string) HeartbeatEvent {
+	return HeartbeatEvent{
+		BaseEvent: BaseEvent{
+			Event:     "heartbeat",
+			ID:        clientID,
+			Timestamp: time.Now().UTC(),
+		},
+		Content: HeartbeatContent{
+			Check: check,
+		},
+	}
+}
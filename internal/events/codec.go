@@ -0,0 +1,101 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Codec is used to encode and decode events. Every event can be encoded with
+// any codec, the codec used for a connection is chosen during the handshake.
+//
+// The handshake itself is always encoded as JSON, as the client and server
+// do not know which codecs the other supports until it is complete.
+type Codec interface {
+	// Name of the codec, used in logs and errors.
+	Name() string
+
+	// Encode the event into a byte slice.
+	Marshal(event interface{}) ([]byte, error)
+
+	// Decode the data into the event, which must be a pointer.
+	Unmarshal(data []byte, event interface{}) error
+
+	// Decode only the base of the event. This is used to determine the
+	// event type before the full event is decoded.
+	UnmarshalBase(data []byte) (BaseEvent, error)
+}
+
+// The codecs implemented by this package. JSON is the default codec, and is
+// the only codec available until the binary feature is negotiated.
+var (
+	JSON   Codec = jsonCodec{}
+	Binary Codec = binaryCodec{}
+)
+
+// Encodes the events as JSON using the standard library. The JSON tags on
+// the event structs define the names of the fields.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(event interface{}) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func (jsonCodec) Unmarshal(data []byte, event interface{}) error {
+	return json.Unmarshal(data, event)
+}
+
+func (jsonCodec) UnmarshalBase(data []byte) (BaseEvent, error) {
+	var base BaseEvent
+	if err := json.Unmarshal(data, &base); err != nil {
+		return BaseEvent{}, err
+	}
+	return base, nil
+}
+
+// PeekBase decodes as much of the base event as it can from the start of an
+// event, which may be truncated. This is used to correlate an error with the
+// request when the whole event could not be read, such as when it is larger
+// than the max event size. Fields which could not be decoded are left empty.
+func PeekBase(codec Codec, data []byte) BaseEvent {
+	if base, err := codec.UnmarshalBase(data); err == nil || codec != JSON {
+		return base
+	}
+
+	// The JSON is read one field at a time, so the fields which come before
+	// the point where the data was cut off can still be decoded.
+	var base BaseEvent
+	d := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := d.Token(); err != nil || tok != json.Delim('{') {
+		return base
+	}
+
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return base
+		}
+
+		var target interface{}
+		switch tok {
+		case "event":
+			target = &base.Event
+		case "id":
+			target = &base.ID
+		case "request_id":
+			target = &base.RequestID
+		case "timestamp":
+			target = &base.Timestamp
+		default:
+			target = &json.RawMessage{}
+		}
+
+		if err := d.Decode(target); err != nil {
+			return base
+		}
+	}
+	return base
+}
@@ -0,0 +1,74 @@
+package events
+
+// Error codes returned by the server in the ErrorEvent and the
+// ConnectionRejectedEvent. Many of the codes follow the HTTP status
+// codes, but their meaning is specific to the events API.
+//
+// The descriptions for each code can be found in doc/error_codes.md,
+// keep both in sync when adding a new code.
+const (
+	// The event sent by the client could not be parsed.
+	CodeBadRequest = 400
+
+	// The client has not authenticated with the server.
+	CodeUnauthorized = 401
+
+	// The client is authenticated but does not have the correct
+	// permissions to perform the action.
+	CodeForbidden = 403
+
+	// The event sent by the client is larger than the max event size
+	// accepted by the server.
+	CodePayloadTooLarge = 413
+
+	// The client sent an event before completing the handshake.
+	CodeHandshakeRequired = 428
+
+	// The client has sent too many events, or too much data, and
+	// must slow down.
+	CodeTooManyRequests = 429
+
+	// The server failed to handle the event due to an internal error.
+	CodeInternalError = 500
+
+	// The event type sent by the client is not handled by the server.
+	CodeNotImplemented = 501
+
+	// The server is unable to handle the request, such as when it is
+	// at its max connection limit.
+	CodeServiceUnavailable = 504
+
+	// The protocol version used by the client is not supported by the
+	// server, or the client is not using the framed protocol.
+	CodeVersionNotSupported = 505
+)
+
+// CodeText returns a short text for the error code, which is used as
+// the prefix of the reason sent to the client. An empty string is
+// returned if the code is unknown.
+func CodeText(code int) string {
+	switch code {
+	case CodeBadRequest:
+		return "Bad Request"
+	case CodeUnauthorized:
+		return "Unauthorized"
+	case CodeForbidden:
+		return "Forbidden"
+	case CodePayloadTooLarge:
+		return "Payload Too Large"
+	case CodeHandshakeRequired:
+		return "Handshake Required"
+	case CodeTooManyRequests:
+		return "Too Many Requests"
+	case CodeInternalError:
+		return "Internal Server Error"
+	case CodeNotImplemented:
+		return "Not Implemented"
+	case CodeServiceUnavailable:
+		return "Service Unavailable"
+	case CodeVersionNotSupported:
+		return "Version Not Supported"
+	default:
+		return ""
+	}
+}
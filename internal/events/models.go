@@ -1,6 +1,9 @@
 package events
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // Base event structure which every event will inherit from.
 // It is assumed that each event will have these details, so
@@ -8,16 +11,67 @@ import "time"
 //
 // Timestamp is using time.Time type, but an int64 might
 // be more appropriate here.
+//
+// RequestID is optional, it is set by a client which expects
+// a response and is copied into the response by the server.
+// This is how a client correlates a response with a request.
 type BaseEvent struct {
 	Event     string    `json:"event"`
 	ID        string    `json:"id"`
+	RequestID string    `json:"request_id,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// Event is implemented by every event through the embedded BaseEvent.
+// It gives callers access to the common details without having to
+// type assert the event returned by the Parser first.
+type Event interface {
+	Base() *BaseEvent
+}
+
+// Base returns a pointer to the base event, which allows the common
+// details of any event to be read and updated.
+func (e *BaseEvent) Base() *BaseEvent {
+	return e
+}
+
 // Empty content structure which is used when an event does
 // not require any content.
 type EmptyContent struct{}
 
+// Stores the content that should be inside the event.
+//
+// The features are the optional features supported by the
+// client, see the protocol constants for the options.
+type HelloContent struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// Event sent by the client to the server as soon as the
+// connection is opened, before any other event.
+type HelloEvent struct {
+	BaseEvent
+	Content HelloContent `json:"content"`
+}
+
+// Stores the content that should be inside the event.
+//
+// The version and features are the values negotiated by
+// the server, which will be used for the rest of the
+// connection.
+type WelcomeContent struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// Event returned by the server to the client when the
+// handshake is complete.
+type WelcomeEvent struct {
+	BaseEvent
+	Content WelcomeContent `json:"content"`
+}
+
 // Stores the content that should be inside the event.
 type ConnectionAcceptedContent struct {
 	ClientID string `json:"client_id"`
@@ -60,6 +114,7 @@ type RequestAuthenticationEvent struct {
 // Stores the content that should be inside the event.
 type ClientAuthenticatedContent struct {
 	ClientID string `json:"client_id"`
+	Device   string `json:"device,omitempty"`
 }
 
 // Event sent by the server to the client when a new client
@@ -79,6 +134,7 @@ type ClientDisconnectingEvent struct {
 // Stores the content that should be inside the event.
 type ClientDisconnectedContent struct {
 	ClientID string `json:"client_id"`
+	Device   string `json:"device,omitempty"`
 }
 
 // Event sent by the server to the client when a client
@@ -89,9 +145,14 @@ type ClientDisconnectedEvent struct {
 }
 
 // Stores the content that should be inside the event.
+//
+// The title, topic and priority are optional, see SendMessageContent.
 type BroadcastMessageContent struct {
-	Message string `json:"message"`
-	Sender  string `json:"sender"`
+	Message  string `json:"message"`
+	Sender   string `json:"sender"`
+	Title    string `json:"title,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Priority string `json:"priority,omitempty"`
 }
 
 // Event sent by the server to the client when a client sends
@@ -102,8 +163,15 @@ type BroadcastMessageEvent struct {
 }
 
 // Stores the content that should be inside the event.
+//
+// The title is shown in place of the sender when the message is displayed,
+// and the topic can be used by the clients to group the messages. When the
+// priority is empty, the message has the normal priority.
 type SendMessageContent struct {
-	Message string `json:"message"`
+	Message  string `json:"message"`
+	Title    string `json:"title,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Priority string `json:"priority,omitempty"`
 }
 
 // Event sent by the client to the server when a client sends
@@ -112,3 +180,82 @@ type SendMessageEvent struct {
 	BaseEvent
 	Content SendMessageContent `json:"content"`
 }
+
+// Stores the content that should be inside the event.
+//
+// The reconnect after field is the number of seconds the client should
+// wait before trying to connect again.
+type ServerShuttingDownContent struct {
+	Reason         string `json:"reason"`
+	ReconnectAfter int    `json:"reconnect_after"`
+}
+
+// Event sent by the server to every client when the server is
+// shutting down, before the connections are closed.
+type ServerShuttingDownEvent struct {
+	BaseEvent
+	Content ServerShuttingDownContent `json:"content"`
+}
+
+// Stores the content that should be inside the event.
+type KickClientContent struct {
+	ClientID string `json:"client_id"`
+}
+
+// Event sent by an admin client to the server to disconnect
+// another client.
+type KickClientEvent struct {
+	BaseEvent
+	Content KickClientContent `json:"content"`
+}
+
+// Stores the content that should be inside the event.
+//
+// The check is the name of a monitor configured on the server.
+type HeartbeatContent struct {
+	Check string `json:"check"`
+}
+
+// Event sent by a client to the server to report that a scheduled
+// job has run, which resets the monitor of the check.
+type HeartbeatEvent struct {
+	BaseEvent
+	Content HeartbeatContent `json:"content"`
+}
+
+// Stores the content that should be inside the event.
+//
+// The request fields are used to correlate the error with the event
+// that caused it. They will be empty if the event could not be parsed.
+type ErrorContent struct {
+	Code             int       `json:"code"`
+	Reason           string    `json:"reason"`
+	RequestEvent     string    `json:"request_event"`
+	RequestTimestamp time.Time `json:"request_timestamp"`
+}
+
+// Event sent by the server to the client when an event sent by
+// the client could not be handled.
+type ErrorEvent struct {
+	BaseEvent
+	Content ErrorContent `json:"content"`
+}
+
+// Error allows the ErrorEvent to be returned as an error, which
+// is used when a client is waiting on the response to a request.
+func (e *ErrorEvent) Error() string {
+	return fmt.Sprintf("%d %s", e.Content.Code, e.Content.Reason)
+}
+
+// Stores the content that should be inside the event.
+type AckContent struct {
+	RequestEvent string `json:"request_event"`
+	Delivered    int    `json:"delivered"`
+}
+
+// Event sent by the server to the client to acknowledge a request
+// which has no other response, such as sending a message.
+type AckEvent struct {
+	BaseEvent
+	Content AckContent `json:"content"`
+}
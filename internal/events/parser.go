@@ -1,27 +1,34 @@
 package events
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 )
 
+// ErrNotImplemented is returned by the Parser when the event type is valid
+// data but the event has not been implemented. This can be used by the caller
+// to tell the difference between malformed data and an unknown event.
+var ErrNotImplemented = errors.New("event type has not been implemented")
+
 // Parse the event type from the data. This is a complex problem due to the
 // polymorphic nature of the events. The event type is stored in the "event"
-// field of the JSON data, and can therefore be marshalled into a struct.
+// field of the base event, which every codec is able to decode on its own.
 //
 // The event type will be returned as an interface{} and will need to be
 // asserted to the correct type.
-func _eventType(data []byte) (interface{}, error) {
-	// Use a struct to unmarshal the event type.
-	var eventType struct {
-		Event string `json:"event"`
-	}
-	if err := json.Unmarshal(data, &eventType); err != nil {
+func _eventType(codec Codec, data []byte) (interface{}, error) {
+	// Use the base event to unmarshal the event type.
+	eventType, err := codec.UnmarshalBase(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to determine event type: %s", err)
 	}
 
 	var event interface{}
 	switch eventType.Event {
+	case "hello":
+		event = &HelloEvent{}
+	case "welcome":
+		event = &WelcomeEvent{}
 	case "connection_accepted":
 		event = &ConnectionAcceptedEvent{}
 	case "connection_rejected":
@@ -38,8 +45,18 @@ func _eventType(data []byte) (interface{}, error) {
 		event = &SendMessageEvent{}
 	case "broadcast_message":
 		event = &BroadcastMessageEvent{}
+	case "kick_client":
+		event = &KickClientEvent{}
+	case "heartbeat":
+		event = &HeartbeatEvent{}
+	case "error":
+		event = &ErrorEvent{}
+	case "ack":
+		event = &AckEvent{}
+	case "server_shutting_down":
+		event = &ServerShuttingDownEvent{}
 	default:
-		return nil, fmt.Errorf("Event type '%s' has not been implemented.", eventType.Event)
+		return nil, fmt.Errorf("%w: '%s'", ErrNotImplemented, eventType.Event)
 	}
 
 	return event, nil
@@ -57,15 +74,33 @@ func _eventType(data []byte) (interface{}, error) {
 // Events are not scoped to server or client so this function can be used
 // for both the server and the client. However, do not check for server
 // events on the client, or vice versa.
+//
+// The data must be encoded as JSON, use ParseWith for other codecs.
 func Parser(data []byte) (interface{}, error) {
-	event, err := _eventType(data)
+	return ParseWith(JSON, data)
+}
+
+// ParseWith works the same as the Parser, but the data is decoded using
+// the provided codec instead of JSON.
+func ParseWith(codec Codec, data []byte) (interface{}, error) {
+	event, err := _eventType(codec, data)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(data, event); err != nil {
+	if err := codec.Unmarshal(data, event); err != nil {
 		return nil, err
 	}
 
 	return event, nil
 }
+
+// ParseBase is used to parse only the base details of an event. This is
+// useful when the full event could not be parsed, but the details are still
+// required, such as correlating an error with the event which caused it.
+//
+// The data must be encoded as JSON, use the UnmarshalBase method of a codec
+// for other codecs.
+func ParseBase(data []byte) (BaseEvent, error) {
+	return JSON.UnmarshalBase(data)
+}
@@ -0,0 +1,82 @@
+package events
+
+import "slices"
+
+// The version of the event protocol implemented by this package. The version
+// must be bumped whenever a change is made to the events or the framing that
+// older clients would not understand.
+//
+// The server accepts any client between the min and current version, the
+// version sent by the client in the hello event is the version used for the
+// rest of the connection.
+//
+// The binary codec does not include field names, so a binary event can only
+// be decoded by a peer using the same version. Binary is only enabled for
+// clients using the current version.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Optional features which can be enabled during the handshake. A feature is
+// only enabled when both the client and the server support it.
+const (
+	// The server will send an ack in response to requests which have no
+	// other response, such as sending a message.
+	FeatureAcks = "acks"
+
+	// Events are encoded using the binary codec instead of JSON once the
+	// handshake is complete.
+	FeatureBinary = "binary"
+
+	// Large payloads are compressed with deflate once the handshake is
+	// complete, each side decides its own size threshold.
+	FeatureCompression = "compression"
+)
+
+// The priorities a message can be sent with, from lowest to highest.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+// Priorities returns every priority a message can be sent with, from lowest
+// to highest.
+func Priorities() []string {
+	return []string{PriorityLow, PriorityNormal, PriorityHigh, PriorityUrgent}
+}
+
+// IsValidPriority checks if the priority is one of the known priorities.
+// An empty priority is valid, and means the normal priority.
+func IsValidPriority(priority string) bool {
+	return priority == "" || slices.Contains(Priorities(), priority)
+}
+
+// SupportedFeatures returns every optional feature implemented by this
+// package. This is the default set of features advertised in the handshake.
+func SupportedFeatures() []string {
+	return []string{FeatureAcks, FeatureBinary, FeatureCompression}
+}
+
+// NegotiateFeatures returns the features which are found in both the local
+// and remote lists. The features are returned in the order of the local list.
+func NegotiateFeatures(local, remote []string) []string {
+	features := make([]string, 0, len(local))
+	for _, feature := range local {
+		for _, r := range remote {
+			if feature == r {
+				features = append(features, feature)
+				break
+			}
+		}
+	}
+	return features
+}
+
+// IsVersionSupported checks if the protocol version is within the range of
+// versions supported by this package.
+func IsVersionSupported(version int) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
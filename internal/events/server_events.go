@@ -2,6 +2,27 @@ package events
 
 import "time"
 
+// Create and return a new WelcomeEvent. This function does not generate any
+// details, instead it requires all details as arguments. Which should be
+// generated elsewhere.
+//
+// The version and features should be the values negotiated with the client.
+//
+// All timestamps will be sent back in UTC format.
+func NewWelcomeEvent(serverID string, version int, features []string) WelcomeEvent {
+	return WelcomeEvent{
+		BaseEvent: BaseEvent{
+			Event:     "welcome",
+			ID:        serverID,
+			Timestamp: time.Now().UTC(),
+		},
+		Content: WelcomeContent{
+			Version:  version,
+			Features: features,
+		},
+	}
+}
+
 // Create and return a new ConnectionAcceptedEvent. This function does not
 // generate any details, instead it requires all details as arguments. Which
 // should be generated elsewhere.
@@ -43,8 +64,11 @@ func NewConnectionRejectedEvent(serverID string, code int, reason string) Connec
 // generate any details, instead it requires all details as arguments. Which
 // should be generated elsewhere.
 //
+// The device is the name of the device the client authenticated as, which
+// is empty when the server does not use TLS.
+//
 // All timestamps will be sent back in UTC format.
-func NewClientAuthenticatedEvent(serverID, clientID string) ClientAuthenticatedEvent {
+func NewClientAuthenticatedEvent(serverID, clientID, device string) ClientAuthenticatedEvent {
 	return ClientAuthenticatedEvent{
 		BaseEvent: BaseEvent{
 			Event:     "client_authenticated",
@@ -53,6 +77,7 @@ func NewClientAuthenticatedEvent(serverID, clientID string) ClientAuthenticatedE
 		},
 		Content: ClientAuthenticatedContent{
 			ClientID: clientID,
+			Device:   device,
 		},
 	}
 }
@@ -61,8 +86,11 @@ func NewClientAuthenticatedEvent(serverID, clientID string) ClientAuthenticatedE
 // generate any details, instead it requires all details as arguments. Which
 // should be generated elsewhere.
 //
+// The device is the name of the device the client authenticated as, which
+// is empty when the server does not use TLS.
+//
 // All timestamps will be sent back in UTC format.
-func NewClientDisconnectedEvent(serverID, clientID string) ClientDisconnectedEvent {
+func NewClientDisconnectedEvent(serverID, clientID, device string) ClientDisconnectedEvent {
 	return ClientDisconnectedEvent{
 		BaseEvent: BaseEvent{
 			Event:     "client_disconnected",
@@ -71,6 +99,7 @@ func NewClientDisconnectedEvent(serverID, clientID string) ClientDisconnectedEve
 		},
 		Content: ClientDisconnectedContent{
 			ClientID: clientID,
+			Device:   device,
 		},
 	}
 }
@@ -96,3 +125,74 @@ func NewBroadcastMessageEvent(serverID, clientID, message string) BroadcastMessa
 		},
 	}
 }
+
+// Create and return a new ErrorEvent. This function does not generate any
+// details, instead it requires all details as arguments. Which should be
+// generated elsewhere.
+//
+// The request is the base of the event which caused the error, it is used
+// to correlate the error with the request on the client. If the request
+// could not be parsed, an empty BaseEvent can be passed.
+//
+// All timestamps will be sent back in UTC format.
+func NewErrorEvent(serverID string, code int, reason string, request BaseEvent) ErrorEvent {
+	return ErrorEvent{
+		BaseEvent: BaseEvent{
+			Event:     "error",
+			ID:        serverID,
+			RequestID: request.RequestID,
+			Timestamp: time.Now().UTC(),
+		},
+		Content: ErrorContent{
+			Code:             code,
+			Reason:           reason,
+			RequestEvent:     request.Event,
+			RequestTimestamp: request.Timestamp,
+		},
+	}
+}
+
+// Create and return a new AckEvent. This function does not generate any
+// details, instead it requires all details as arguments. Which should be
+// generated elsewhere.
+//
+// The request event is the name of the event being acknowledged, and the
+// delivered count is the number of clients which received the result of
+// the request, which is zero for requests that are not broadcast.
+//
+// All timestamps will be sent back in UTC format.
+func NewAckEvent(serverID, requestEvent string, delivered int) AckEvent {
+	return AckEvent{
+		BaseEvent: BaseEvent{
+			Event:     "ack",
+			ID:        serverID,
+			Timestamp: time.Now().UTC(),
+		},
+		Content: AckContent{
+			RequestEvent: requestEvent,
+			Delivered:    delivered,
+		},
+	}
+}
+
+// Create and return a new ServerShuttingDownEvent. This function does not
+// generate any details, instead it requires all details as arguments. Which
+// should be generated elsewhere.
+//
+// The reconnect after duration is rounded up to whole seconds, it is only a
+// hint for the clients and does not need to be exact.
+//
+// All timestamps will be sent back in UTC format.
+func NewServerShuttingDownEvent(serverID, reason string, reconnectAfter time.Duration) ServerShuttingDownEvent {
+	return ServerShuttingDownEvent{
+		BaseEvent: BaseEvent{
+			Event:     "server_shutting_down",
+			ID:        serverID,
+			Timestamp: time.Now().UTC(),
+		},
+		Content: ServerShuttingDownContent{
+			Reason:         reason,
+			ReconnectAfter: int((reconnectAfter + time.Second - 1) / time.Second),
+		},
+	}
+}
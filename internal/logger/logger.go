@@ -2,6 +2,8 @@ package logger
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"time"
 )
 
@@ -27,6 +29,10 @@ type LoggerOpts struct {
 	// Whether or not to include a timestamp in the
 	// log output.
 	Timestamp bool
+
+	// Where the log messages are written, use io.Discard
+	// to disable logging.
+	Output io.Writer
 }
 
 // Provide a default log level for the logger.
@@ -43,12 +49,20 @@ func WithTimestamp() LoggerOptsFunc {
 	}
 }
 
+// Provide where the log messages are written.
+func WithOutput(output io.Writer) LoggerOptsFunc {
+	return func(opts *LoggerOpts) {
+		opts.Output = output
+	}
+}
+
 // Defines the default logger options, if they are not
 // provided by the user.
 func defaultLoggerOpts() LoggerOpts {
 	return LoggerOpts{
 		DefaultLevel: INFO,
 		Timestamp:    false,
+		Output:       os.Stdout,
 	}
 }
 
@@ -106,8 +120,8 @@ func (l *Logger) Log(message string, level ...LogLevel) {
 	}
 
 	if l.Opts.Timestamp {
-		fmt.Printf("[%s] [%s] %s", logLevel, time.Now().Format(time.RFC3339), message)
+		fmt.Fprintf(l.Opts.Output, "[%s] [%s] %s", logLevel, time.Now().Format(time.RFC3339), message)
 	} else {
-		fmt.Printf("[%s] %s", logLevel, message)
+		fmt.Fprintf(l.Opts.Output, "[%s] %s", logLevel, message)
 	}
 }
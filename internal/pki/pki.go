@@ -0,0 +1,263 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// The names of the files stored in the PKI directory. The CA and server
+// files are stored at the root of the directory, and each client has its
+// own pair of files in the clients directory, named after the device.
+const (
+	CACertFile     = "ca.crt"
+	CAKeyFile      = "ca.key"
+	ServerCertFile = "server.crt"
+	ServerKeyFile  = "server.key"
+	ClientsDir     = "clients"
+)
+
+// Organization stored in the subject of every certificate.
+const organization = "Gophernest"
+
+// Device names are used as file names and as the common name of the client
+// certificates, so only a safe set of characters is allowed.
+var deviceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// CA is a local certificate authority used to sign the server and client
+// certificates. Both the server and the clients trust the CA certificate,
+// which allows each side to verify the other.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// InitCA creates a new certificate authority and stores it in the directory.
+// An existing CA will never be overwritten, as every certificate signed by it
+// would stop working.
+func InitCA(dir, name string, validity time.Duration) (*CA, error) {
+	certPath := filepath.Join(dir, CACertFile)
+	if _, err := os.Stat(certPath); err == nil {
+		return nil, fmt.Errorf("CA already exists: %s", certPath)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{organization}},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair(certPath, filepath.Join(dir, CAKeyFile), der, key); err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// LoadCA loads the certificate authority stored in the directory by InitCA.
+func LoadCA(dir string) (*CA, error) {
+	cert, err := LoadCertificate(filepath.Join(dir, CACertFile))
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("CA key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot be used to sign certificates")
+	}
+
+	return &CA{Cert: cert, Key: signer}, nil
+}
+
+// IssueServer creates a certificate for the server, signed by the CA, and
+// stores it in the directory. The hosts are the DNS names and IP addresses
+// the clients will use to connect, which are stored as SANs in the
+// certificate. Clients verify the server name against the SANs.
+func (ca *CA) IssueServer(dir string, hosts []string, validity time.Duration) (*x509.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("server certificate requires at least one host")
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0], Organization: []string{organization}, OrganizationalUnit: []string{"Notifications"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return ca.issue(template, validity, filepath.Join(dir, ServerCertFile), filepath.Join(dir, ServerKeyFile))
+}
+
+// IssueClient creates a certificate for a client device, signed by the CA,
+// and stores it in the clients directory. The device name is stored as the
+// common name and as a DNS SAN, and is used by the server to identify the
+// device.
+func (ca *CA) IssueClient(dir, device string, validity time.Duration) (*x509.Certificate, error) {
+	if !deviceName.MatchString(device) {
+		return nil, fmt.Errorf("invalid device name: '%s'", device)
+	}
+
+	certPath, keyPath := ClientPaths(dir, device)
+	if _, err := os.Stat(certPath); err == nil {
+		return nil, fmt.Errorf("client certificate already exists: %s", certPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: device, Organization: []string{organization}, OrganizationalUnit: []string{"Devices"}},
+		DNSNames:    []string{device},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	return ca.issue(template, validity, certPath, keyPath)
+}
+
+// Sign the template with the CA and write the certificate and a new key to
+// the provided paths.
+func (ca *CA) issue(template *x509.Certificate, validity time.Duration, certPath, keyPath string) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-5 * time.Minute)
+	template.NotAfter = time.Now().Add(validity)
+
+	// A certificate cannot outlive the CA which signed it
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// ClientPaths returns the paths of the certificate and key for a device.
+func ClientPaths(dir, device string) (string, string) {
+	base := filepath.Join(dir, ClientsDir, device)
+	return base + ".crt", base + ".key"
+}
+
+// LoadCertificate loads the first certificate from a PEM encoded file.
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// LoadCertPool loads a pool of certificates from a PEM encoded file. This is
+// used to load the CA certificate which the server and clients trust.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Write the certificate and key as PEM encoded files. The key is only
+// readable by the owner.
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return os.WriteFile(keyPath, keyPEM, 0600)
+}
+
+// Create a random 128 bit serial number for a certificate.
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
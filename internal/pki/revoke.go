@@ -0,0 +1,120 @@
+package pki
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Name of the revocation list stored in the PKI directory.
+const RevokedFile = "revoked.txt"
+
+// RevocationList is the set of client certificates which are no longer
+// trusted, even though they are signed by the CA. The list is stored as a
+// text file with one certificate per line, the serial number in hex followed
+// by the name of the device and when it was revoked. Blank lines and lines
+// starting with '#' are ignored.
+//
+//	# serial                           device        revoked
+//	3f2a9c...                          laptop-alice  2024-05-01T12:00:00Z
+type RevocationList struct {
+	// The revoked serial numbers in lower case hex, mapped to the
+	// name of the device they were issued to.
+	Serials map[string]string
+}
+
+// LoadRevocationList loads the revocation list from a file. If the file does
+// not exist, an empty list is returned, as no devices have been revoked.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	list := &RevocationList{Serials: make(map[string]string)}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString(fields[0], 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number on line %d of %s", line, path)
+		}
+
+		device := ""
+		if len(fields) > 1 {
+			device = fields[1]
+		}
+		list.Serials[serial.Text(16)] = device
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// IsRevoked checks if the certificate has been revoked. This is safe to call
+// on a nil list, which has no revoked certificates.
+func (l *RevocationList) IsRevoked(cert *x509.Certificate) bool {
+	if l == nil || cert == nil {
+		return false
+	}
+	_, ok := l.Serials[cert.SerialNumber.Text(16)]
+	return ok
+}
+
+// Revoke adds the certificate of a device to the revocation list, then
+// deletes the certificate and key of the device so a new certificate can
+// be issued under the same name.
+//
+// The revoked certificate is returned. The server reloads the list when the
+// file changes, and disconnects the device if it is connected.
+func Revoke(dir, device string) (*x509.Certificate, error) {
+	if !deviceName.MatchString(device) {
+		return nil, fmt.Errorf("invalid device name: '%s'", device)
+	}
+
+	certPath, keyPath := ClientPaths(dir, device)
+	cert, err := LoadCertificate(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, RevokedFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(file, "%s %s %s\n", cert.SerialNumber.Text(16), device, time.Now().UTC().Format(time.RFC3339))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The certificate is in the revocation list, so the files are no
+	// longer of any use.
+	if err := os.Remove(certPath); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(keyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,152 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+)
+
+// Permission is an action a device is allowed to perform on the server.
+type Permission string
+
+// The permissions which can be granted to a role.
+const (
+	// Send messages which are broadcast to the other clients.
+	Publish Permission = "publish"
+
+	// Receive the messages and events broadcast by the server.
+	Subscribe Permission = "subscribe"
+
+	// Perform admin actions, such as disconnecting other clients.
+	Admin Permission = "admin"
+)
+
+// Every permission known to the server, used to validate the policy file.
+var permissions = []Permission{Publish, Subscribe, Admin}
+
+// Policy maps the identity of each device to the roles it holds, and each
+// role to the permissions it grants. The identity of a device is the name
+// in the certificate it presents to the server.
+//
+// The policy is loaded from a JSON file, for example:
+//
+//	{
+//	    "roles": {
+//	        "admin": ["publish", "subscribe", "admin"],
+//	        "desktop": ["subscribe"],
+//	        "runner": ["publish"]
+//	    },
+//	    "devices": {
+//	        "laptop-alice": ["admin"],
+//	        "desktop-*": ["desktop"],
+//	        "ci-*": ["runner"]
+//	    },
+//	    "default": []
+//	}
+//
+// Device names may be patterns, using the syntax of path.Match. A device is
+// given the roles of every entry it matches. Devices which do not match any
+// entry are given the default roles, which also apply to clients connecting
+// without TLS, as they have no device name.
+type Policy struct {
+	// The permissions granted by each role.
+	Roles map[string][]Permission `json:"roles"`
+
+	// The roles held by each device, or pattern of device names.
+	Devices map[string][]string `json:"devices"`
+
+	// The roles held by devices which are not listed.
+	Default []string `json:"default"`
+}
+
+// AllowAll returns a policy which grants every permission to every device.
+// This is used when the server is not provided with a policy file.
+func AllowAll() *Policy {
+	return &Policy{
+		Roles:   map[string][]Permission{"all": permissions},
+		Devices: map[string][]string{},
+		Default: []string{"all"},
+	}
+}
+
+// Load the policy from a JSON file. An error is returned if the file cannot
+// be read, or if it refers to a role or permission which does not exist.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %s", path, err)
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %s", path, err)
+	}
+	return &policy, nil
+}
+
+// Check that every role and permission in the policy exists, and that the
+// device patterns are valid. Mistakes in the policy file would otherwise
+// silently deny access.
+func (p *Policy) validate() error {
+	for role, perms := range p.Roles {
+		for _, perm := range perms {
+			if !utils.Contains(permissions, perm) {
+				return fmt.Errorf("role '%s' has unknown permission '%s'", role, perm)
+			}
+		}
+	}
+
+	checkRoles := func(roles []string, owner string) error {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return fmt.Errorf("%s has unknown role '%s'", owner, role)
+			}
+		}
+		return nil
+	}
+
+	for device, roles := range p.Devices {
+		if _, err := path.Match(device, ""); err != nil {
+			return fmt.Errorf("device pattern '%s' is invalid", device)
+		}
+		if err := checkRoles(roles, fmt.Sprintf("device '%s'", device)); err != nil {
+			return err
+		}
+	}
+	return checkRoles(p.Default, "default")
+}
+
+// Permissions returns every permission granted to the device, through all of
+// the roles it holds. An empty device name is given the default roles.
+func (p *Policy) Permissions(device string) []Permission {
+	var roles []string
+	matched := false
+	if device != "" {
+		for pattern, patternRoles := range p.Devices {
+			if ok, _ := path.Match(pattern, device); ok {
+				roles = append(roles, patternRoles...)
+				matched = true
+			}
+		}
+	}
+	if !matched {
+		roles = p.Default
+	}
+
+	granted := []Permission{}
+	for _, role := range roles {
+		for _, perm := range p.Roles[role] {
+			if !utils.Contains(granted, perm) {
+				granted = append(granted, perm)
+			}
+		}
+	}
+	return granted
+}
@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits defines the rate at which a client may send events to the server,
+// as both the number of events and their size. Each rate has a burst, which
+// is the amount the client may send at once before it is limited.
+//
+// A rate of zero disables that limit.
+type Limits struct {
+	// Events per second, and the number of events allowed at once.
+	MessagesPerSec float64
+	MessageBurst   int
+
+	// Bytes per second, and the number of bytes allowed at once.
+	BytesPerSec float64
+	ByteBurst   int
+}
+
+// Bucket is a token bucket. Tokens are added at a constant rate, up to the
+// size of the burst, and each action removes tokens from the bucket. When
+// there are not enough tokens, the action is not allowed.
+//
+// A nil bucket has no limit, every action is allowed.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a bucket which is full, so the client is able to use the
+// whole burst straight away. If the rate is not positive, nil is returned
+// as the bucket would have no limit.
+func NewBucket(rate float64, burst int) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow removes n tokens from the bucket, if there are enough. An action
+// larger than the burst is allowed once the bucket is full, emptying it,
+// otherwise it could never be allowed.
+func (b *Bucket) Allow(n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	n = min(n, b.burst)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Return tokens to the bucket, used when an action was allowed by this
+// bucket but not by another.
+func (b *Bucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+min(n, b.burst))
+}
+
+// Limiter applies both of the limits to the events sent by a client.
+type Limiter struct {
+	messages *Bucket
+	bytes    *Bucket
+}
+
+// NewLimiter creates a limiter which enforces the limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		messages: NewBucket(limits.MessagesPerSec, limits.MessageBurst),
+		bytes:    NewBucket(limits.BytesPerSec, limits.ByteBurst),
+	}
+}
+
+// Allow checks if an event of the size, in bytes, is allowed. The event is
+// only counted against the limits when it is allowed.
+func (l *Limiter) Allow(size int) bool {
+	if l == nil {
+		return true
+	}
+
+	if !l.messages.Allow(1) {
+		return false
+	}
+	if !l.bytes.Allow(float64(size)) {
+		l.messages.refund(1)
+		return false
+	}
+	return true
+}
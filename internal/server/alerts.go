@@ -0,0 +1,296 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+)
+
+// The HTTP gateway can receive alerts from monitoring systems, each alert is
+// published as a message so it shows up as a desktop notification. Alerts are
+// received on two endpoints, which use the same tokens as the publish endpoint:
+//
+//	POST /alerts/alertmanager   The webhook payload of Prometheus Alertmanager.
+//	POST /alerts/{receiver}     Any JSON payload, translated by the alert
+//	                            mapping of the receiver in the server options.
+//
+// The priority of each message is derived from the severity of the alert, see
+// severityPriority. Resolved alerts are also published, with a low priority,
+// so the recipients know the problem has gone away.
+
+// Topic of the messages published for the alerts received from Alertmanager.
+const alertmanagerTopic = "alerts"
+
+// Values of the status of an alert which mean the alert has been resolved.
+// The status is compared without case.
+var resolvedStatuses = []string{"resolved", "ok", "recovered", "closed"}
+
+// AlertMapping describes how to translate the JSON payload sent to a generic
+// alert receiver into messages. The fields other than the topic are paths to
+// values in the payload, the keys are separated by periods and array elements
+// are selected by their index, such as 'alerts.0.labels.severity'.
+type AlertMapping struct {
+	// Path to an array in the payload, each element is translated into a
+	// message with the paths below relative to the element. When empty,
+	// the payload is a single alert.
+	Items string `json:"items"`
+
+	// Paths to the text and title of the message. The message is required,
+	// the title defaults to the name of the receiver.
+	Message string `json:"message"`
+	Title   string `json:"title"`
+
+	// Paths to the severity of the alert, which sets the priority of the
+	// message, and to the status of the alert, which marks it as resolved.
+	Severity string `json:"severity"`
+	Status   string `json:"status"`
+
+	// Topic of the messages, this is not a path.
+	Topic string `json:"topic"`
+}
+
+// Webhook payload sent by Alertmanager, only the fields used to build the
+// messages are decoded.
+type alertmanagerPayload struct {
+	Status string              `json:"status"`
+	Alerts []alertmanagerAlert `json:"alerts"`
+}
+
+// A single alert in the Alertmanager payload.
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Body of the response to an alert receiver, the number of alerts published,
+// the number of clients they were delivered to across every alert, and the
+// number of alerts which could not be broadcast.
+type alertsResponse struct {
+	Alerts    int `json:"alerts"`
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+}
+
+// Get the priority of a message for the severity of an alert. The common names
+// used by monitoring systems are recognised, any other severity is normal.
+func severityPriority(severity string) string {
+	switch strings.ToLower(strings.TrimSpace(severity)) {
+	case "critical", "crit", "emergency", "emerg", "fatal", "page", "p1":
+		return events.PriorityUrgent
+	case "error", "err", "high", "major", "p2":
+		return events.PriorityHigh
+	case "info", "informational", "low", "minor", "none", "debug", "p4", "p5":
+		return events.PriorityLow
+	default:
+		return events.PriorityNormal
+	}
+}
+
+// Check if the status of an alert means it has been resolved.
+func isResolved(status string) bool {
+	for _, resolved := range resolvedStatuses {
+		if strings.EqualFold(strings.TrimSpace(status), resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the message for an alert. Resolved alerts are always low priority, and
+// their title is marked so they are not mistaken for the alert itself.
+func alertMessage(title, message, severity string, resolved bool) events.SendMessageContent {
+	content := events.SendMessageContent{
+		Message:  message,
+		Title:    "[FIRING] " + title,
+		Priority: severityPriority(severity),
+	}
+	if resolved {
+		content.Title = "[RESOLVED] " + title
+		content.Priority = events.PriorityLow
+	}
+	return content
+}
+
+// Handle the webhook sent by Alertmanager. Each alert in the group is published
+// as its own message, the title is the name of the alert and the message is
+// its summary or description.
+func (s *TcpServer) handleAlertmanager(w http.ResponseWriter, r *http.Request) {
+	name, ok := s.authorizeGateway(w, r)
+	if !ok {
+		return
+	}
+
+	var payload alertmanagerPayload
+	if !s.decodeGatewayBody(w, r, &payload) {
+		return
+	}
+
+	messages := make([]events.SendMessageContent, 0, len(payload.Alerts))
+	for _, alert := range payload.Alerts {
+		// The status of the group is used when the alert does not have
+		// its own, which is the case for older versions.
+		status := alert.Status
+		if status == "" {
+			status = payload.Status
+		}
+
+		title := alert.Labels["alertname"]
+		if title == "" {
+			title = "Alert"
+		}
+
+		text := alert.Annotations["summary"]
+		if text == "" {
+			text = alert.Annotations["description"]
+		}
+		if text == "" {
+			text = title
+		}
+
+		content := alertMessage(title, text, alert.Labels["severity"], isResolved(status))
+		content.Topic = alertmanagerTopic
+		messages = append(messages, content)
+	}
+
+	s.publishAlerts(w, name, "alertmanager", messages)
+}
+
+// Handle the payload sent to a generic alert receiver, using the alert mapping
+// of the receiver in the server options.
+func (s *TcpServer) handleAlertReceiver(w http.ResponseWriter, r *http.Request) {
+	name, ok := s.authorizeGateway(w, r)
+	if !ok {
+		return
+	}
+
+	receiver := r.PathValue("receiver")
+	mapping, found := s.Opts.AlertMappings[receiver]
+	if !found {
+		writeGatewayError(w, http.StatusNotFound, fmt.Sprintf("Unknown Receiver: There is no alert receiver named '%s'", receiver))
+		return
+	}
+
+	var payload interface{}
+	if !s.decodeGatewayBody(w, r, &payload) {
+		return
+	}
+
+	items := []interface{}{payload}
+	if mapping.Items != "" {
+		value, _ := lookupPath(payload, mapping.Items)
+		array, isArray := value.([]interface{})
+		if !isArray {
+			writeGatewayError(w, http.StatusBadRequest, fmt.Sprintf("Invalid Payload: '%s' is not an array", mapping.Items))
+			return
+		}
+		items = array
+	}
+
+	messages := make([]events.SendMessageContent, 0, len(items))
+	for i, item := range items {
+		text := lookupString(item, mapping.Message)
+		if text == "" {
+			writeGatewayError(w, http.StatusBadRequest, fmt.Sprintf("Missing Message: Alert %d does not have a value at '%s'", i, mapping.Message))
+			return
+		}
+
+		title := lookupString(item, mapping.Title)
+		if title == "" {
+			title = receiver
+		}
+
+		content := alertMessage(title, text, lookupString(item, mapping.Severity), isResolved(lookupString(item, mapping.Status)))
+		content.Topic = mapping.Topic
+		messages = append(messages, content)
+	}
+
+	s.publishAlerts(w, name, receiver, messages)
+}
+
+// Publish the messages built from the alerts received by an alert receiver,
+// and write the response. Every alert is published even if an earlier one
+// could not be broadcast, since the sender retries the whole request on an
+// error, which would duplicate the alerts that were published. The response
+// is only an error when none of the alerts could be published.
+func (s *TcpServer) publishAlerts(w http.ResponseWriter, publisher, receiver string, messages []events.SendMessageContent) {
+	res := alertsResponse{}
+	for _, message := range messages {
+		delivered, err := s.Publish(publisher, message)
+		if err != nil {
+			s.Logger.Log(fmt.Sprintf("Error publishing alert from receiver '%s': %s\n", receiver, err), logger.ERROR)
+			res.Failed++
+			continue
+		}
+		res.Alerts++
+		res.Delivered += delivered
+	}
+
+	if res.Alerts == 0 && res.Failed > 0 {
+		writeGatewayError(w, http.StatusInternalServerError, "Broadcast Failed: Message could not be broadcast")
+		return
+	}
+
+	s.Logger.Log(fmt.Sprintf("Publisher '%s' sent %d alert(s) to receiver '%s'\n", publisher, res.Alerts, receiver), logger.DEBUG)
+	writeGatewayJSON(w, http.StatusOK, res)
+}
+
+// Get the value at the path in a decoded JSON document. The keys of the path
+// are separated by periods, and array elements are selected by their index.
+// False is returned if there is no value at the path.
+func lookupPath(document interface{}, path string) (interface{}, bool) {
+	value := document
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Get the value at the path as a string. Numbers and booleans are formatted,
+// objects and arrays are encoded as JSON. An empty path, or a path without a
+// value, returns an empty string.
+func lookupString(document interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	value, ok := lookupPath(document, path)
+	if !ok || value == nil {
+		return ""
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+}
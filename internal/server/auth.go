@@ -1,18 +1,28 @@
 package server
 
-import "net"
+import (
+	"fmt"
+	"net"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/policy"
+)
 
 // Check if the client is authenticated. If they are not authenticated, they
 // will be able to send messages to the server and they will not be able to
 // receive messages from the server.
 //
-// Using the clientID and the address of the client, the server can determine
-// if the client is authenticated and if the client ID is being used by
-// another client.
+// Using the clientID and the connection of the client, the server can
+// determine if the client is authenticated and if the client ID is being used
+// by another client.
 //
-// This function assumes the address stored in the server's Authorized map
-// is the RemoteAddr of the client.
+// The connections are compared instead of their addresses, as every client
+// connected over the Unix socket has the same address.
 func (s *TcpServer) isAuthenticated(clientID string, conn net.Conn) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	// Get the connection from the authorized map via the clientID.
 	// If the client is not in the map, they are not authenticated.
 	connAuth, ok := s.Authorized[clientID]
@@ -22,5 +32,27 @@ func (s *TcpServer) isAuthenticated(clientID string, conn net.Conn) bool {
 
 	// If they are in the map, validate that the connection sending the message
 	// is the same connection that was authorized to use the clientID.
-	return conn.RemoteAddr().String() == connAuth.RemoteAddr().String()
+	return connAuth == conn
+}
+
+// Check if the client was granted a permission by the server's policy. If it
+// was not, a forbidden error is sent back to the client, correlated with the
+// request, and false is returned.
+//
+// This should only be called once the client is known to be authenticated,
+// otherwise the client should be sent an unauthorized error instead.
+func (s *TcpServer) authorize(conn net.Conn, permission policy.Permission, request events.BaseEvent) bool {
+	session := s.session(conn)
+	if session.HasPermission(permission) {
+		return true
+	}
+
+	device := ""
+	if session != nil {
+		device = session.Device
+	}
+
+	s.Logger.Log(fmt.Sprintf("Device '%s' does not have the '%s' permission: %s\n", device, permission, conn.RemoteAddr().String()), logger.ERROR)
+	s.SendError(conn, events.CodeForbidden, fmt.Sprintf("Insufficient Permissions: Device does not have the '%s' permission", permission), request)
+	return false
 }
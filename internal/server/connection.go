@@ -1,7 +1,6 @@
 package server
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +9,7 @@ import (
 
 	"github.com/Azpect3120/TCPNotificationManager/internal/events"
 	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/wire"
 )
 
 // Handle a connection from a client. This method is defined on the
@@ -20,9 +20,24 @@ import (
 // by clients should contain the client ID which can be used to
 // authenticate and verify the client.
 //
+// The first event sent by the client must be the hello event, which
+// completes the handshake. Any other event sent before the handshake
+// will be rejected.
+//
 // This function will handle the memory management of the connection,
 // and will close the connection when it is done.
-func (s *TcpServer) HandleConnection(conn net.Conn) {
+func (s *TcpServer) HandleConnection(netConn net.Conn) {
+	// Wrap the connection so events can be read and written as frames. The
+	// wrapped connection is used everywhere from here on, including as the
+	// key for the connection in the server's state.
+	conn := wire.NewConn(netConn, s.Opts.MsgBufSize)
+	conn.Stats = &s.Metrics.Compression
+	conn.WriteTimeout = s.Opts.WriteTimeout
+	conn.MaxFrameSize = s.Opts.MaxEventSize
+	if ws, ok := netConn.(*wire.WebSocketConn); ok {
+		ws.MaxMessageSize = s.Opts.MaxEventSize + wire.HeaderSize
+	}
+
 	// Defer the closing of the connection until the function returns.
 	defer func() {
 		conn.Close()
@@ -30,68 +45,150 @@ func (s *TcpServer) HandleConnection(conn net.Conn) {
 		s.removeConnection(conn)
 	}()
 
+	// Complete the TLS handshake and identify the device using the
+	// certificate it presented, or the user which connected over the Unix
+	// socket. The device is used as the identity of the client once it
+	// authenticates.
+	device, err := s.identify(netConn)
+	if err != nil {
+		s.Logger.Log(fmt.Sprintf("Error identifying client %s: %s\n", conn.RemoteAddr().String(), err), logger.ERROR)
+		return
+	}
+
 	// Add the connection to the server's connection slice. This action
 	// does not authenticate the client, but it does allow the server to
 	// track the connection.
-	if err := s.addConnection(conn); err != nil {
+	if err := s.addConnection(conn, device); errors.Is(err, ErrServerClosed) {
+		s.Send(conn, events.NewConnectionRejectedEvent(s.ID, events.CodeServiceUnavailable, "Server Shutting Down: Server is not accepting connections"))
+		return
+	} else if err != nil {
 		// Send back a rejection message
-		bytes, _ := json.Marshal(events.NewConnectionRejectedEvent(s.ID, 504, "Server Full: Server is at its max capacity"))
-		conn.Write(bytes)
+		s.Send(conn, events.NewConnectionRejectedEvent(s.ID, events.CodeServiceUnavailable, "Server Full: Server is at its max capacity"))
 		return
 	}
 
 	// Print a connection log in the server, this is not to be broadcast to the clients.
-	s.Logger.Log(fmt.Sprintf("Connection accepted: %s\n", conn.RemoteAddr().String()))
+	if device != "" {
+		s.Logger.Log(fmt.Sprintf("Connection accepted: %s (%s)\n", conn.RemoteAddr().String(), device))
+	} else {
+		s.Logger.Log(fmt.Sprintf("Connection accepted: %s\n", conn.RemoteAddr().String()))
+	}
+
+	// The session is only removed once this function returns. The events
+	// broadcast to the client are written by their own goroutine, which
+	// stops when the session is removed.
+	session := s.session(conn)
+	go s.writeLoop(session)
 
-	// Create a buffer to read the messages from the clients. The size
-	// of the buffer is defined in the server's options. Default is 1KB.
-	buf := make([]byte, s.Opts.MsgBufSize)
+	// Read the frames sent by the client. The size of the read buffer is
+	// defined in the server's options. Default is 1KB, but frames larger
+	// than the buffer can still be read.
 	for {
-		n, err := conn.Read(buf)
+		frame, err := conn.ReadFrame()
 		// Connection was closed by the client
 		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
 			return
+		} else if errors.Is(err, wire.ErrLegacyProtocol) {
+			// The client is sending unframed JSON, so it was built before the
+			// handshake was added. The rejection is sent unframed so the client
+			// is able to parse it.
+			s.Logger.Log(fmt.Sprintf("Client using legacy protocol: %s\n", conn.RemoteAddr().String()), logger.ERROR)
+			if bytes, err := events.JSON.Marshal(events.NewConnectionRejectedEvent(s.ID, events.CodeVersionNotSupported, "Unsupported Protocol: Client must send a hello event using the framed protocol")); err == nil {
+				netConn.Write(bytes)
+			}
+			return
+		} else if errors.Is(err, wire.ErrFrameTooLarge) {
+			// The event was discarded without being read, so the connection
+			// can be kept open for the next event. The frame still costs the
+			// server a read and a reply, so it is charged to the rate limit
+			// at the max event size and counts as a strike, otherwise a
+			// client could send oversized frames forever.
+			s.Logger.Log(fmt.Sprintf("Error reading from connection: %v\n", err), logger.ERROR)
+			session.allow(s.Opts.MaxEventSize)
+			if s.strike(session) {
+				s.Logger.Log(fmt.Sprintf("Client sent too many oversized events, disconnecting: %s\n", conn.RemoteAddr().String()), logger.WARN)
+				s.SendError(conn, events.CodeTooManyRequests, "Too Many Violations: Client sent too many oversized events", frame.PeekBase())
+				return
+			}
+			s.SendError(conn, events.CodePayloadTooLarge, fmt.Sprintf("Payload Too Large: Event exceeds the max event size of %d bytes", s.Opts.MaxEventSize), frame.PeekBase())
+			continue
 		} else if err != nil {
 			// Else, a real error occurred
 			s.Logger.Log(fmt.Sprintf("Error reading from connection: %v\n", err), logger.ERROR)
 			return
 		}
 
-		// This is where the messages should be parsed and processed.
-		if n > 0 {
-			// Displaying the message received from the client
-			s.Logger.Log(fmt.Sprintf("%s\n", string(buf[:n])), logger.DEBUG)
+		// Displaying the message received from the client
+		s.Logger.Log(fmt.Sprintf("%s\n", frame), logger.DEBUG)
 
-			event, err := events.Parser(buf[:n])
-			if err != nil {
-				// This happens when an event that is not implemented is received.
-				s.Logger.Log(fmt.Sprintf("Error parsing message: %v\n", err), logger.ERROR)
+		// Events over the rate limit are dropped without being handled. A
+		// client which keeps exceeding the limit is disconnected.
+		if !session.allow(len(frame.Payload)) {
+			base, _ := frame.DecodeBase()
+			if s.strike(session) {
+				s.Logger.Log(fmt.Sprintf("Client exceeded the rate limit too many times, disconnecting: %s\n", conn.RemoteAddr().String()), logger.WARN)
+				s.SendError(conn, events.CodeTooManyRequests, "Too Many Violations: Client exceeded the rate limit too many times", base)
 				return
 			}
 
-			// Handle the event. A check for authorization should be done
-			// in the handlers for the events, because there is no way to,
-			// get data from the raw interface{} type until it has been
-			// type asserted.
-			eventType := reflect.TypeOf(event).Elem()
-			eventName := eventType.Name()
-
-			if handler, ok := s.EventHandlers[eventName]; ok {
-				// Correctly assert the handler type
-				handlerType := reflect.TypeOf(handler)
-
-				// Check if the handler type matches the event type. This
-				// shit is black magic, Gemini created it for me, it seems
-				// make sense but definitely not something I could have done
-				// on my own.
-				if handlerType.NumIn() == 3 && handlerType.In(2) == reflect.PointerTo(reflect.TypeOf(event).Elem()) {
-					reflect.ValueOf(handler).Call([]reflect.Value{reflect.ValueOf(s), reflect.ValueOf(conn), reflect.ValueOf(event)})
-				} else {
-					s.Logger.Log(fmt.Sprintln("Handler type mismatch for", eventName), logger.ERROR)
-				}
+			s.Logger.Log(fmt.Sprintf("Client exceeded the rate limit: %s\n", conn.RemoteAddr().String()), logger.WARN)
+			s.SendError(conn, events.CodeTooManyRequests, "Rate Limited: Client is sending events too quickly", base)
+			continue
+		}
+
+		// The frame is decoded using the codec it was encoded with
+		event, err := frame.Decode()
+		if err != nil {
+			s.Logger.Log(fmt.Sprintf("Error parsing message: %v\n", err), logger.ERROR)
+
+			// The base is parsed on its own so the error can be correlated
+			// with the request, if the data is malformed it will be empty.
+			base, _ := frame.DecodeBase()
+
+			// This happens when an event that is not implemented is received.
+			// The data is still valid, so the connection can be kept open.
+			if errors.Is(err, events.ErrNotImplemented) {
+				s.SendError(conn, events.CodeNotImplemented, fmt.Sprintf("Unknown Event: Event type '%s' is not supported", base.Event), base)
+				continue
+			}
+
+			s.SendError(conn, events.CodeBadRequest, "Malformed Event: Event could not be parsed", base)
+			return
+		}
+
+		// Handle the event. A check for authorization should be done
+		// in the handlers for the events, because there is no way to,
+		// get data from the raw interface{} type until it has been
+		// type asserted.
+		eventType := reflect.TypeOf(event).Elem()
+		eventName := eventType.Name()
+		base := *event.(events.Event).Base()
+
+		// No events can be handled until the client has completed the
+		// handshake, as the server does not know which protocol version
+		// or features the client is using.
+		if _, ok := event.(*events.HelloEvent); !ok && !s.session(conn).HasHandshake() {
+			s.SendError(conn, events.CodeHandshakeRequired, "Handshake Required: Client must send a hello event first", base)
+			continue
+		}
+
+		if handler, ok := s.EventHandlers[eventName]; ok {
+			// Correctly assert the handler type
+			handlerType := reflect.TypeOf(handler)
+
+			// Check if the handler type matches the event type. This
+			// shit is black magic, Gemini created it for me, it seems
+			// make sense but definitely not something I could have done
+			// on my own.
+			if handlerType.NumIn() == 3 && handlerType.In(2) == reflect.PointerTo(reflect.TypeOf(event).Elem()) {
+				reflect.ValueOf(handler).Call([]reflect.Value{reflect.ValueOf(s), reflect.ValueOf(conn), reflect.ValueOf(event)})
 			} else {
-				s.Logger.Log(fmt.Sprintln("No handler found for", eventName), logger.ERROR)
+				s.Logger.Log(fmt.Sprintln("Handler type mismatch for", eventName), logger.ERROR)
+				s.SendError(conn, events.CodeInternalError, "Handler Error: Event could not be handled", base)
 			}
+		} else {
+			s.Logger.Log(fmt.Sprintln("No handler found for", eventName), logger.ERROR)
+			s.SendError(conn, events.CodeNotImplemented, fmt.Sprintf("Unknown Event: Event type '%s' is not handled by the server", base.Event), base)
 		}
 	}
 }
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/policy"
+	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+)
+
+// Time allowed for a client of the HTTP gateway to send the request headers.
+const gatewayHeaderTimeout = 10 * time.Second
+
+// The HTTP gateway allows programs which cannot speak the event protocol, such
+// as shell scripts, to publish messages with a single request:
+//
+//	curl -X POST http://127.0.0.1:8081/publish \
+//	    -H "Authorization: Bearer <token>" \
+//	    -d '{"message": "Backup finished", "title": "Backups", "priority": "high"}'
+//
+// The message is published through the same path as the send_message event,
+// and the response contains the number of clients the message was delivered
+// to. Errors are returned as JSON with a code and reason, in the same format
+// as the error event.
+
+// Body of a publish request sent to the HTTP gateway.
+type publishRequest struct {
+	Message  string `json:"message"`
+	Title    string `json:"title"`
+	Topic    string `json:"topic"`
+	Priority string `json:"priority"`
+}
+
+// Body of the response to a successful publish request.
+type publishResponse struct {
+	Delivered int `json:"delivered"`
+}
+
+// Body of the response to a failed request.
+type gatewayError struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// HTTPHandler returns the handler of the HTTP gateway. ListenAndServe starts
+// the gateway when the HTTP address is set in the server options, programs
+// embedding the server can use the handler to serve the gateway themselves.
+func (s *TcpServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /publish", s.handlePublish)
+	mux.HandleFunc("POST /alerts/alertmanager", s.handleAlertmanager)
+	mux.HandleFunc("POST /alerts/{receiver}", s.handleAlertReceiver)
+	mux.HandleFunc("GET /checks", s.handleChecks)
+	mux.HandleFunc("POST /checks/{check}/ping", s.handleHeartbeat)
+	return mux
+}
+
+// Start the HTTP gateway on the HTTP address in the server options. The
+// gateway is stopped by Shutdown.
+func (s *TcpServer) startGateway() error {
+	ln, err := net.Listen("tcp", s.Opts.HTTPAddr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           s.HTTPHandler(),
+		ReadHeaderTimeout: gatewayHeaderTimeout,
+	}
+
+	s.mu.Lock()
+	s.httpServer = server
+	s.mu.Unlock()
+
+	s.Logger.Log(fmt.Sprintf("HTTP gateway started on %s\n", ln.Addr()))
+	go func() {
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Log(fmt.Sprintf("HTTP gateway stopped: %s\n", err), logger.ERROR)
+		}
+	}()
+	return nil
+}
+
+// Stop the HTTP gateway, waiting for the requests in progress to finish or
+// the context to expire. Does nothing if the gateway was not started.
+func (s *TcpServer) stopGateway(ctx context.Context) error {
+	s.mu.RLock()
+	server := s.httpServer
+	s.mu.RUnlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// Find the publisher the bearer token of the request belongs to. Every token
+// is compared in constant time, so the response time does not leak how much
+// of a token was correct.
+func (s *TcpServer) publisher(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+
+	publisher, found := "", false
+	for name, t := range s.Opts.HTTPTokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			publisher, found = name, true
+		}
+	}
+	return publisher, found
+}
+
+// Handle a publish request sent to the HTTP gateway. The publisher must have
+// the publish permission in the server's policy, like the clients do.
+func (s *TcpServer) handlePublish(w http.ResponseWriter, r *http.Request) {
+	name, ok := s.authorizeGateway(w, r)
+	if !ok {
+		return
+	}
+
+	var body publishRequest
+	if !s.decodeGatewayBody(w, r, &body) {
+		return
+	}
+
+	if body.Message == "" {
+		writeGatewayError(w, http.StatusBadRequest, "Missing Message: The message field is required")
+		return
+	}
+
+	delivered, err := s.Publish(name, events.SendMessageContent{
+		Message:  body.Message,
+		Title:    body.Title,
+		Topic:    body.Topic,
+		Priority: body.Priority,
+	})
+	if errors.Is(err, ErrInvalidPriority) {
+		writeGatewayError(w, http.StatusBadRequest, fmt.Sprintf("Invalid Priority: Priority must be one of %s", strings.Join(events.Priorities(), ", ")))
+		return
+	} else if err != nil {
+		writeGatewayError(w, http.StatusInternalServerError, "Broadcast Failed: Message could not be broadcast")
+		return
+	}
+
+	s.Logger.Log(fmt.Sprintf("Publisher '%s' published a message over HTTP to %d client(s)\n", name, delivered), logger.DEBUG)
+	writeGatewayJSON(w, http.StatusOK, publishResponse{Delivered: delivered})
+}
+
+// Check the request to the HTTP gateway is from a known publisher with the
+// publish permission. When it is not, the error response has been written
+// and false is returned.
+func (s *TcpServer) authorizeGateway(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.draining.Load() {
+		writeGatewayError(w, http.StatusServiceUnavailable, "Server Shutting Down: Server is restarting or stopping")
+		return "", false
+	}
+
+	name, ok := s.publisher(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeGatewayError(w, http.StatusUnauthorized, "Not Authenticated: Missing or unknown bearer token")
+		return "", false
+	}
+
+	if !utils.Contains(s.Policy.Permissions(name), policy.Publish) {
+		writeGatewayError(w, http.StatusForbidden, fmt.Sprintf("Insufficient Permissions: Publisher does not have the '%s' permission", policy.Publish))
+		return "", false
+	}
+	return name, true
+}
+
+// Decode the JSON body of a request to the HTTP gateway into v, the body can
+// be up to the max event size. When it cannot be decoded, the error response
+// has been written and false is returned.
+func (s *TcpServer) decodeGatewayBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(s.Opts.MaxEventSize))
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeGatewayError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Payload Too Large: Body exceeds the max event size of %d bytes", s.Opts.MaxEventSize))
+			return false
+		}
+		writeGatewayError(w, http.StatusBadRequest, fmt.Sprintf("Malformed Body: %s", err))
+		return false
+	}
+	return true
+}
+
+// Write the value as the JSON body of the response.
+func writeGatewayJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write an error response, the code in the body is the status code.
+func writeGatewayError(w http.ResponseWriter, status int, reason string) {
+	writeGatewayJSON(w, status, gatewayError{Code: status, Reason: reason})
+}
@@ -1,15 +1,75 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
 
 	"github.com/Azpect3120/TCPNotificationManager/internal/events"
 	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/policy"
 	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
 )
 
+// HelloHandler When the client opens a connection, the first event it sends must
+// be the hello event. This function will check the protocol version of the client
+// and negotiate the optional features, then send the welcome event back.
+//
+// If the version is not supported, an error is sent back and the connection is
+// closed, as the server cannot know how to talk to the client. Sending the hello
+// event a second time is not allowed, the features cannot change once enabled.
+func HelloHandler(server *TcpServer, conn net.Conn, event *events.HelloEvent) {
+	session := server.session(conn)
+	if session == nil {
+		server.Logger.Log(fmt.Sprintf("Client not found in server connections: %s\n", conn.RemoteAddr().String()), logger.ERROR)
+		server.SendError(conn, events.CodeInternalError, "Unknown Connection: Connection is not tracked by the server", event.BaseEvent)
+		return
+	}
+
+	if session.HasHandshake() {
+		server.SendError(conn, events.CodeBadRequest, "Duplicate Handshake: Handshake has already been completed", event.BaseEvent)
+		return
+	}
+
+	if !events.IsVersionSupported(event.Content.Version) {
+		server.Logger.Log(fmt.Sprintf("Client using unsupported protocol version %d: %s\n", event.Content.Version, conn.RemoteAddr().String()), logger.ERROR)
+		server.SendError(conn, events.CodeVersionNotSupported, fmt.Sprintf("Unsupported Version: Server supports protocol versions %d to %d", events.MinProtocolVersion, events.ProtocolVersion), event.BaseEvent)
+		conn.Close()
+		return
+	}
+
+	// The layout of the binary events changes between versions, so older
+	// clients must use JSON.
+	features := events.NegotiateFeatures(server.Opts.Features, event.Content.Features)
+	if event.Content.Version < events.ProtocolVersion {
+		features = slices.DeleteFunc(features, func(feature string) bool { return feature == events.FeatureBinary })
+	}
+
+	server.mu.Lock()
+	session.Version = event.Content.Version
+	session.Features = features
+	server.mu.Unlock()
+
+	server.Logger.Log(fmt.Sprintf("Handshake completed with %s: version %d, features %v\n", conn.RemoteAddr().String(), session.Version, features), logger.DEBUG)
+
+	welcome := events.NewWelcomeEvent(server.ID, session.Version, features)
+	if err := server.Reply(conn, event.BaseEvent, &welcome); err != nil {
+		server.Logger.Log(fmt.Sprintf("Error sending response: %s\n", err), logger.ERROR)
+		return
+	}
+
+	// The welcome event is always sent as JSON and uncompressed, so the
+	// features are only enabled after it has been written.
+	if session.HasFeature(events.FeatureBinary) {
+		session.Conn.SetCodec(events.Binary)
+	}
+	if session.HasFeature(events.FeatureCompression) {
+		session.Conn.EnableCompression(server.Opts.CompressionThreshold)
+	}
+}
+
 // RequestAuthenticationHandler When the client sends a request to authenticate,
 // this function will be called.
 // This function will handle the request and send a response back to the client.
@@ -18,44 +78,47 @@ import (
 // as it was already confirmed that there is. This function also assumes that
 // the client is not already authenticated but exists in the Conns slice in
 // the server. If it is not found, an error will be thrown.
+//
+// The identity of the client is the device named in the certificate it presented
+// during the TLS handshake, which is shared with the other clients so they know
+// which device connected.
 func RequestAuthenticationHandler(server *TcpServer, conn net.Conn, event *events.RequestAuthenticationEvent) {
-	var exists bool = false
-	for _, c := range server.Conns {
-		if c == conn {
-			exists = true
-			break
-		}
+	// Authenticate the client, if the connection is still tracked by the server.
+	// The lock is held for both so the connection cannot be removed in between.
+	clientId := utils.GenerateClientID()
+
+	server.mu.Lock()
+	session, exists := server.Sessions[conn]
+	if exists {
+		server.Authorized[clientId] = conn
 	}
+	server.mu.Unlock()
+
 	if !exists {
 		// Send back a rejected message
 		server.Logger.Log(fmt.Sprintf("Client not found in server connections: %s\n", conn.RemoteAddr().String()), logger.ERROR)
+		server.SendError(conn, events.CodeInternalError, "Unknown Connection: Connection is not tracked by the server", event.BaseEvent)
 		return
 	}
 
-	// Authenticate the client
-	clientId := utils.GenerateClientID()
-	server.Authorized[clientId] = conn
-
 	// Display a message for now, but in the future, this can be an event
 	// to all other client, that a new client has been accepted.
-	server.Logger.Log(fmt.Sprintf("A client '%s' has been authenticated\n", clientId))
+	if session.Device != "" {
+		server.Logger.Log(fmt.Sprintf("A client '%s' has been authenticated as '%s'\n", clientId, session.Device))
+	} else {
+		server.Logger.Log(fmt.Sprintf("A client '%s' has been authenticated\n", clientId))
+	}
 
 	// Send back the message to the client
-	if bytes, err := json.Marshal(events.NewConnectionAcceptedEvent(server.ID, clientId)); err != nil {
-		server.Logger.Log(fmt.Sprintf("Error marshalling response: %s\n", err), logger.ERROR)
-	} else {
-		conn.Write(bytes)
+	accepted := events.NewConnectionAcceptedEvent(server.ID, clientId)
+	if err := server.Reply(conn, event.BaseEvent, &accepted); err != nil {
+		server.Logger.Log(fmt.Sprintf("Error sending response: %s\n", err), logger.ERROR)
 	}
 
 	// Client has been authenticated, now we can broadcast the message to all clients
-	message, err := json.Marshal(events.NewClientAuthenticatedEvent(server.ID, clientId))
-	if err != nil {
-		server.Logger.Log(fmt.Sprintf("Error marshalling response: %s\n", err), logger.ERROR)
-	} else {
-		errs := server.BroadcastMessage(message, conn)
-		for _, err := range errs {
-			server.Logger.Log(fmt.Sprintf("Error broadcasting message: %s\n", err), logger.ERROR)
-		}
+	_, errs := server.BroadcastMessage(events.NewClientAuthenticatedEvent(server.ID, clientId, session.Device), conn)
+	for _, err := range errs {
+		server.Logger.Log(fmt.Sprintf("Error broadcasting message: %s\n", err), logger.ERROR)
 	}
 }
 
@@ -67,19 +130,36 @@ func RequestAuthenticationHandler(server *TcpServer, conn net.Conn, event *event
 // Each client is removed from the server's connections slice when they disconnect,
 // so there is no need to remove them here.
 func ClientDisconnectingHandler(server *TcpServer, conn net.Conn, event *events.ClientDisconnectingEvent) {
+	// Only the connection which owns the client ID is allowed to disconnect
+	// it, otherwise any client could disconnect the others.
+	if !server.isAuthenticated(event.ID, conn) {
+		server.Logger.Log(fmt.Sprintf("Client '%s' is not authenticated\n", event.ID), logger.ERROR)
+		server.SendError(conn, events.CodeUnauthorized, "Not Authenticated: Client has not authenticated with the server", event.BaseEvent)
+		return
+	}
+
 	// Delete from the authorized map
+	server.mu.Lock()
 	delete(server.Authorized, event.ID)
+	var device string
+	if session, ok := server.Sessions[conn]; ok {
+		device = session.Device
+	}
+	server.mu.Unlock()
 
 	server.Logger.Log(fmt.Sprintf("Client '%s' has disconnected\n", event.ID), logger.DEBUG)
 
 	// TODO: Broadcast the message to all clients
-	message, err := json.Marshal(events.NewClientDisconnectedEvent(server.ID, event.ID))
-	if err != nil {
-		server.Logger.Log(fmt.Sprintf("Error marshalling response: %s\n", err), logger.ERROR)
-	} else {
-		errs := server.BroadcastMessage(message, conn)
-		for _, err := range errs {
-			server.Logger.Log(fmt.Sprintf("Error broadcasting message: %s\n", err), logger.ERROR)
+	_, errs := server.BroadcastMessage(events.NewClientDisconnectedEvent(server.ID, event.ID, device), conn)
+	for _, err := range errs {
+		server.Logger.Log(fmt.Sprintf("Error broadcasting message: %s\n", err), logger.ERROR)
+	}
+
+	// Acknowledge the disconnection if the client is waiting on a response.
+	if event.RequestID != "" && server.session(conn).HasFeature(events.FeatureAcks) {
+		ack := events.NewAckEvent(server.ID, event.Event, 0)
+		if err := server.Reply(conn, event.BaseEvent, &ack); err != nil {
+			server.Logger.Log(fmt.Sprintf("Error sending response: %s\n", err), logger.ERROR)
 		}
 	}
 }
@@ -89,24 +169,116 @@ func ClientDisconnectingHandler(server *TcpServer, conn net.Conn, event *events.
 //
 // Handling the message will include checking if the client is authenticated, and
 // if the message is valid. If the client is not authenticated, the message will
-// be ignored.
+// be ignored and an error will be sent back to the client. The same happens if
+// the client does not have the publish permission.
 func SendMessageHandler(server *TcpServer, conn net.Conn, event *events.SendMessageEvent) {
 	// Check if the client is authenticated
 	if event.ID == "" {
-		server.Logger.Log(fmt.Sprintf("Client ID is empty\n"), logger.ERROR)
-	} else if _, ok := server.Authorized[event.ID]; !ok {
+		server.Logger.Log("Client ID is empty\n", logger.ERROR)
+		server.SendError(conn, events.CodeUnauthorized, "Not Authenticated: Client ID is empty", event.BaseEvent)
+		return
+	} else if !server.isAuthenticated(event.ID, conn) {
 		server.Logger.Log(fmt.Sprintf("Client '%s' is not authenticated\n", event.ID), logger.ERROR)
+		server.SendError(conn, events.CodeUnauthorized, "Not Authenticated: Client has not authenticated with the server", event.BaseEvent)
+		return
+	} else if !server.authorize(conn, policy.Publish, event.BaseEvent) {
 		return
 	}
 
-	// Broadcast the message to all clients
-	message, err := json.Marshal(events.NewBroadcastMessageEvent(server.ID, event.ID, event.Content.Message))
-	if err != nil {
-		server.Logger.Log(fmt.Sprintf("Error marshalling response: %s\n", err), logger.ERROR)
-	} else {
-		errs := server.BroadcastMessage(message, conn)
-		for _, err := range errs {
-			server.Logger.Log(fmt.Sprintf("Error broadcasting message: %s\n", err), logger.ERROR)
+	// Broadcast the message to all other clients. If the message could not
+	// be delivered to any client, the sender is told the broadcast failed.
+	delivered, err := server.Publish(event.ID, event.Content, conn)
+	if errors.Is(err, ErrInvalidPriority) {
+		server.SendError(conn, events.CodeBadRequest, fmt.Sprintf("Invalid Priority: Priority must be one of %s", strings.Join(events.Priorities(), ", ")), event.BaseEvent)
+		return
+	} else if err != nil {
+		server.SendError(conn, events.CodeInternalError, "Broadcast Failed: Message could not be broadcast", event.BaseEvent)
+		return
+	}
+
+	// Acknowledge the message if the client is waiting on a response, the
+	// number of clients which received the message is sent back.
+	if event.RequestID != "" && server.session(conn).HasFeature(events.FeatureAcks) {
+		ack := events.NewAckEvent(server.ID, event.Event, delivered)
+		if err := server.Reply(conn, event.BaseEvent, &ack); err != nil {
+			server.Logger.Log(fmt.Sprintf("Error sending response: %s\n", err), logger.ERROR)
+		}
+	}
+}
+
+// KickClientHandler When an admin client asks the server to disconnect another
+// client, this function will be called. The connection of the target client is
+// closed and the other clients are told it has disconnected.
+//
+// Only clients with the admin permission are allowed to kick other clients. The
+// kicked client is able to connect again, unless its certificate is revoked.
+func KickClientHandler(server *TcpServer, conn net.Conn, event *events.KickClientEvent) {
+	if !server.isAuthenticated(event.ID, conn) {
+		server.Logger.Log(fmt.Sprintf("Client '%s' is not authenticated\n", event.ID), logger.ERROR)
+		server.SendError(conn, events.CodeUnauthorized, "Not Authenticated: Client has not authenticated with the server", event.BaseEvent)
+		return
+	} else if !server.authorize(conn, policy.Admin, event.BaseEvent) {
+		return
+	}
+
+	// Remove the target from the authorized map, the connection itself is
+	// removed once its goroutine sees the connection has been closed.
+	server.mu.Lock()
+	target, exists := server.Authorized[event.Content.ClientID]
+	var device string
+	if exists {
+		delete(server.Authorized, event.Content.ClientID)
+		if session, ok := server.Sessions[target]; ok {
+			device = session.Device
+		}
+	}
+	server.mu.Unlock()
+
+	if !exists {
+		server.SendError(conn, events.CodeBadRequest, fmt.Sprintf("Unknown Client: Client '%s' is not connected", event.Content.ClientID), event.BaseEvent)
+		return
+	}
+
+	server.Logger.Log(fmt.Sprintf("Client '%s' was kicked by '%s'\n", event.Content.ClientID, event.ID), logger.WARN)
+	target.Close()
+
+	_, errs := server.BroadcastMessage(events.NewClientDisconnectedEvent(server.ID, event.Content.ClientID, device), target)
+	for _, err := range errs {
+		server.Logger.Log(fmt.Sprintf("Error broadcasting message: %s\n", err), logger.ERROR)
+	}
+
+	if event.RequestID != "" && server.session(conn).HasFeature(events.FeatureAcks) {
+		ack := events.NewAckEvent(server.ID, event.Event, 0)
+		if err := server.Reply(conn, event.BaseEvent, &ack); err != nil {
+			server.Logger.Log(fmt.Sprintf("Error sending response: %s\n", err), logger.ERROR)
+		}
+	}
+}
+
+// HeartbeatHandler When a client reports that a scheduled job has run, this
+// function will be called. The heartbeat is recorded for the check, and if the
+// check had missed its heartbeat the clients are told it has recovered.
+//
+// Only clients with the publish permission are allowed to send heartbeats, as
+// a missed or recovered check publishes a message to every client.
+func HeartbeatHandler(server *TcpServer, conn net.Conn, event *events.HeartbeatEvent) {
+	if !server.isAuthenticated(event.ID, conn) {
+		server.Logger.Log(fmt.Sprintf("Client '%s' is not authenticated\n", event.ID), logger.ERROR)
+		server.SendError(conn, events.CodeUnauthorized, "Not Authenticated: Client has not authenticated with the server", event.BaseEvent)
+		return
+	} else if !server.authorize(conn, policy.Publish, event.BaseEvent) {
+		return
+	}
+
+	if err := server.Heartbeat(event.Content.Check); errors.Is(err, ErrUnknownCheck) {
+		server.SendError(conn, events.CodeBadRequest, fmt.Sprintf("Unknown Check: There is no check named '%s'", event.Content.Check), event.BaseEvent)
+		return
+	}
+
+	if event.RequestID != "" && server.session(conn).HasFeature(events.FeatureAcks) {
+		ack := events.NewAckEvent(server.ID, event.Event, 0)
+		if err := server.Reply(conn, event.BaseEvent, &ack); err != nil {
+			server.Logger.Log(fmt.Sprintf("Error sending response: %s\n", err), logger.ERROR)
 		}
 	}
 }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/wire"
+)
+
+// Time allowed for the client to complete the TLS handshake, after which
+// the connection is closed.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Get the certificate the client presented during the TLS handshake. If the
+// connection does not use TLS, or the handshake has not completed, nil is
+// returned.
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := unwrapTLS(conn)
+	if !ok {
+		return nil
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// Find the TLS connection under the layers added by the server, such as the
+// framing and WebSocket connections. False is returned if the connection does
+// not use TLS.
+func unwrapTLS(conn net.Conn) (*tls.Conn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return c, true
+		case *wire.Conn:
+			conn = c.Conn
+		case *wire.WebSocketConn:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Get the name of the device a certificate was issued to. The common name
+// is used, and if it is empty, the first DNS name. Certificates issued by
+// 'tnm pki client' store the device name in both.
+func deviceName(cert *x509.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// Identify the device on the other side of the connection. For a TLS
+// connection, the handshake is completed here so the certificate of the
+// client has been verified before any events are read. The name of the
+// device the certificate was issued to is returned.
+//
+// For a connection over a Unix socket, the device is identified by the user
+// which owns the process on the other side, see identifyUnix.
+//
+// When the connection does not use TLS, the device is unknown and an empty
+// string is returned.
+func (s *TcpServer) identify(conn net.Conn) (string, error) {
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		return s.identifyUnix(unixConn)
+	}
+
+	tlsConn, ok := unwrapTLS(conn)
+	if !ok {
+		return "", nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	device := deviceName(peerCertificate(tlsConn))
+	if device == "" {
+		return "", fmt.Errorf("client certificate does not contain a device name")
+	}
+	return device, nil
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/wire"
+)
+
+// Metrics holds the counters tracked by the server over its lifetime. The
+// counters are safe to read while the server is running.
+type Metrics struct {
+	// Compression stats for every connection to the server, use the
+	// CompressionRatio method to get the overall ratio.
+	Compression wire.Stats
+
+	// Events dropped because the outbound queue of a client was full.
+	DroppedEvents atomic.Int64
+
+	// Clients disconnected because their outbound queue was full.
+	SlowConsumers atomic.Int64
+
+	// Webhook deliveries which succeeded, and which failed and were
+	// written to the dead letter log.
+	WebhooksDelivered atomic.Int64
+	WebhooksFailed    atomic.Int64
+}
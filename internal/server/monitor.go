@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+)
+
+// Monitors alert the clients when a scheduled job does not report that it has
+// run. The job sends a heartbeat for its check each time it runs, using the
+// heartbeat event or the HTTP gateway:
+//
+//	curl -X POST http://127.0.0.1:8081/checks/nightly-backup/ping \
+//	    -H "Authorization: Bearer <token>"
+//
+// When a check has not received a heartbeat within its interval plus the grace
+// period, the server publishes an alert. Once the check receives a heartbeat
+// again, a recovery message is published. The interval of a check starts when
+// the server is created, so a job which never reports is also caught.
+
+// ErrUnknownCheck is returned when a heartbeat is sent for a check which is
+// not configured on the server.
+var ErrUnknownCheck = errors.New("unknown check")
+
+// How often the monitors are checked for missed heartbeats.
+const monitorPollInterval = time.Second
+
+// Sender of the messages published by the monitors.
+const monitorSender = "monitor"
+
+// Monitor is a check which expects a heartbeat at least once per interval.
+type Monitor struct {
+	// How often the job is expected to report, and how long after the
+	// interval to wait before alerting, to allow for jobs which run late.
+	Interval time.Duration
+	Grace    time.Duration
+
+	// Topic of the alert and recovery messages, and the priority of the
+	// alert, which defaults to high. Recoveries have the low priority.
+	Topic    string
+	Priority string
+}
+
+// Decode a monitor from JSON. The interval and grace period are durations
+// such as "24h" or "15m", see time.ParseDuration.
+func (m *Monitor) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Interval string `json:"interval"`
+		Grace    string `json:"grace"`
+		Topic    string `json:"topic"`
+		Priority string `json:"priority"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	interval, err := time.ParseDuration(raw.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid interval: %w", err)
+	}
+
+	var grace time.Duration
+	if raw.Grace != "" {
+		if grace, err = time.ParseDuration(raw.Grace); err != nil {
+			return fmt.Errorf("invalid grace period: %w", err)
+		}
+	}
+
+	*m = Monitor{Interval: interval, Grace: grace, Topic: raw.Topic, Priority: raw.Priority}
+	return nil
+}
+
+// Check the monitor is valid.
+func (m Monitor) validate() error {
+	if m.Interval <= 0 {
+		return errors.New("interval must be greater than zero")
+	}
+	if m.Grace < 0 {
+		return errors.New("grace period cannot be negative")
+	}
+	if !events.IsValidPriority(m.Priority) {
+		return fmt.Errorf("invalid priority '%s'", m.Priority)
+	}
+	return nil
+}
+
+// CheckStatus is the state of a check, returned by the HTTP gateway.
+type CheckStatus struct {
+	Name string `json:"name"`
+
+	// When the last heartbeat was received, nil if there has not been one
+	// since the server started.
+	LastPing *time.Time `json:"last_ping"`
+
+	// When the check will be marked as down if there is no heartbeat.
+	Due time.Time `json:"due"`
+
+	// Whether the check has missed its heartbeat.
+	Down bool `json:"down"`
+}
+
+// The state of a single check.
+type monitorState struct {
+	lastPing time.Time
+	down     bool
+}
+
+// The state of every check, created from the monitors in the server options.
+type monitorSet struct {
+	start sync.Once
+
+	// When the monitors were created, which is used in place of the last
+	// heartbeat until the first one is received.
+	created time.Time
+
+	mu     sync.Mutex
+	states map[string]*monitorState
+}
+
+// Create the state of each monitor in the server options.
+func (s *TcpServer) initMonitors() {
+	s.monitors.created = time.Now()
+	s.monitors.states = make(map[string]*monitorState, len(s.Opts.Monitors))
+	for name := range s.Opts.Monitors {
+		s.monitors.states[name] = &monitorState{}
+	}
+}
+
+// Start checking the monitors for missed heartbeats, until the server is shut
+// down. Does nothing if there are no monitors, or they have already started.
+func (s *TcpServer) startMonitors() {
+	if len(s.Opts.Monitors) == 0 {
+		return
+	}
+
+	s.monitors.start.Do(func() {
+		go func() {
+			ticker := time.NewTicker(monitorPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.done:
+					return
+				case now := <-ticker.C:
+					s.checkMonitors(now)
+				}
+			}
+		}()
+	})
+}
+
+// Get when a check is due, the end of its interval and grace period since the
+// last heartbeat.
+func (s *TcpServer) monitorDue(monitor Monitor, state *monitorState) time.Time {
+	last := state.lastPing
+	if last.IsZero() {
+		last = s.monitors.created
+	}
+	return last.Add(monitor.Interval + monitor.Grace)
+}
+
+// Publish an alert for every check which has missed its heartbeat. An alert is
+// only published once, until the check recovers.
+func (s *TcpServer) checkMonitors(now time.Time) {
+	var alerts []events.SendMessageContent
+
+	s.monitors.mu.Lock()
+	for name, monitor := range s.Opts.Monitors {
+		state := s.monitors.states[name]
+		if state.down || now.Before(s.monitorDue(monitor, state)) {
+			continue
+		}
+		state.down = true
+
+		since := "the server started"
+		if !state.lastPing.IsZero() {
+			since = state.lastPing.UTC().Format(time.RFC3339)
+		}
+
+		priority := monitor.Priority
+		if priority == "" {
+			priority = events.PriorityHigh
+		}
+
+		alerts = append(alerts, events.SendMessageContent{
+			Title:    fmt.Sprintf("[DOWN] %s", name),
+			Message:  fmt.Sprintf("'%s' has not checked in since %s, it is expected every %s", name, since, monitor.Interval),
+			Topic:    monitor.Topic,
+			Priority: priority,
+		})
+		s.Logger.Log(fmt.Sprintf("Check '%s' missed its heartbeat\n", name), logger.WARN)
+	}
+	s.monitors.mu.Unlock()
+
+	// The messages are published without holding the lock, so heartbeats
+	// are not held up by a slow broadcast.
+	for _, alert := range alerts {
+		if _, err := s.Publish(monitorSender, alert); err != nil {
+			s.Logger.Log(fmt.Sprintf("Error publishing alert for check: %s\n", err), logger.ERROR)
+		}
+	}
+}
+
+// Heartbeat records a heartbeat for the check with the name. If the check had
+// missed its heartbeat, a recovery message is published. ErrUnknownCheck is
+// returned if the check is not configured on the server.
+func (s *TcpServer) Heartbeat(name string) error {
+	monitor, ok := s.Opts.Monitors[name]
+	if !ok {
+		return fmt.Errorf("%w: '%s'", ErrUnknownCheck, name)
+	}
+
+	now := time.Now()
+	s.monitors.mu.Lock()
+	state := s.monitors.states[name]
+	recovered := state.down
+	downFor := now.Sub(s.monitorDue(monitor, state))
+	state.lastPing = now
+	state.down = false
+	s.monitors.mu.Unlock()
+
+	s.Logger.Log(fmt.Sprintf("Heartbeat received for check '%s'\n", name), logger.DEBUG)
+	if !recovered {
+		return nil
+	}
+
+	s.Logger.Log(fmt.Sprintf("Check '%s' has recovered\n", name), logger.INFO)
+	_, err := s.Publish(monitorSender, events.SendMessageContent{
+		Title:    fmt.Sprintf("[UP] %s", name),
+		Message:  fmt.Sprintf("'%s' checked in again, %s after it was due", name, downFor.Round(time.Second)),
+		Topic:    monitor.Topic,
+		Priority: events.PriorityLow,
+	})
+	if err != nil {
+		s.Logger.Log(fmt.Sprintf("Error publishing recovery for check: %s\n", err), logger.ERROR)
+	}
+	return nil
+}
+
+// Checks returns the state of every check, sorted by name.
+func (s *TcpServer) Checks() []CheckStatus {
+	s.monitors.mu.Lock()
+	defer s.monitors.mu.Unlock()
+
+	checks := make([]CheckStatus, 0, len(s.Opts.Monitors))
+	for name, monitor := range s.Opts.Monitors {
+		state := s.monitors.states[name]
+		status := CheckStatus{Name: name, Due: s.monitorDue(monitor, state), Down: state.down}
+		if !state.lastPing.IsZero() {
+			lastPing := state.lastPing
+			status.LastPing = &lastPing
+		}
+		checks = append(checks, status)
+	}
+
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
+
+// Handle a heartbeat sent to the HTTP gateway.
+func (s *TcpServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	name, ok := s.authorizeGateway(w, r)
+	if !ok {
+		return
+	}
+
+	check := r.PathValue("check")
+	if err := s.Heartbeat(check); errors.Is(err, ErrUnknownCheck) {
+		writeGatewayError(w, http.StatusNotFound, fmt.Sprintf("Unknown Check: There is no check named '%s'", check))
+		return
+	}
+
+	s.Logger.Log(fmt.Sprintf("Publisher '%s' sent a heartbeat for check '%s' over HTTP\n", name, check), logger.DEBUG)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handle a request for the state of the checks sent to the HTTP gateway.
+func (s *TcpServer) handleChecks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorizeGateway(w, r); !ok {
+		return
+	}
+	writeGatewayJSON(w, http.StatusOK, s.Checks())
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+)
+
+// QueuePolicy decides what happens when an event is sent to a client whose
+// outbound queue is full, which happens when the client is not reading the
+// events as fast as they are sent.
+type QueuePolicy int
+
+const (
+	// Drop the oldest event in the queue to make room for the new one.
+	DropOldest QueuePolicy = iota
+
+	// Drop the new event, keeping the events already in the queue.
+	DropNewest
+
+	// Disconnect the client, it is too slow to keep up.
+	DisconnectSlow
+)
+
+// Errors returned when an event could not be queued for a client.
+var (
+	ErrQueueFull    = errors.New("outbound queue is full, event dropped")
+	ErrSlowConsumer = errors.New("outbound queue is full, client disconnected")
+)
+
+// A frame waiting to be written to the client. The payload is encoded before
+// it is queued, so it can be shared between clients using the same codec.
+type outFrame struct {
+	flags   byte
+	payload []byte
+}
+
+// The outbound queue of a connection. Events broadcast to the client are
+// added to the queue, and written by the writer goroutine of the connection,
+// so a slow client never blocks the sender.
+type outbox struct {
+	frames chan outFrame
+
+	// Number of frames which have been queued but not yet written,
+	// including the frame being written.
+	pending atomic.Int64
+
+	// Closed when the connection is removed, which stops the writer.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Create an outbound queue which holds up to size frames.
+func newOutbox(size int) *outbox {
+	if size < 1 {
+		size = 1
+	}
+
+	return &outbox{
+		frames: make(chan outFrame, size),
+		done:   make(chan struct{}),
+	}
+}
+
+// Check if every queued frame has been written to the client.
+func (o *outbox) flushed() bool {
+	return o.pending.Load() == 0
+}
+
+// Stop the writer goroutine, frames left in the queue are discarded.
+func (o *outbox) close() {
+	o.doneOnce.Do(func() { close(o.done) })
+}
+
+// Add a frame to the outbound queue of the session. This never blocks, if
+// the queue is full the queue policy of the server decides what happens.
+func (s *TcpServer) enqueue(session *Session, frame outFrame) error {
+	// The frame is counted before it is queued, otherwise the writer could
+	// take it and finish writing it first, and the outbox would look flushed
+	// while the frame is still queued.
+	session.outbox.pending.Add(1)
+	select {
+	case session.outbox.frames <- frame:
+		return nil
+	default:
+		session.outbox.pending.Add(-1)
+	}
+
+	switch s.Opts.QueuePolicy {
+	case DropNewest:
+		s.Metrics.DroppedEvents.Add(1)
+		return ErrQueueFull
+
+	case DisconnectSlow:
+		s.Metrics.SlowConsumers.Add(1)
+		s.Logger.Log(fmt.Sprintf("Client is not keeping up with events, disconnecting: %s\n", session.Conn.RemoteAddr().String()), logger.WARN)
+		session.Conn.Close()
+		return ErrSlowConsumer
+
+	default:
+		// Other goroutines may be adding to the queue at the same time, so
+		// keep dropping the oldest event until there is space.
+		for {
+			select {
+			case <-session.outbox.frames:
+				session.outbox.pending.Add(-1)
+				s.Metrics.DroppedEvents.Add(1)
+			default:
+			}
+
+			session.outbox.pending.Add(1)
+			select {
+			case session.outbox.frames <- frame:
+				return nil
+			default:
+				session.outbox.pending.Add(-1)
+			}
+		}
+	}
+}
+
+// Write the frames in the outbound queue of the session to the client, until
+// the connection is removed. Each write has a deadline, see the WriteTimeout
+// server option, if a write fails the connection is closed.
+func (s *TcpServer) writeLoop(session *Session) {
+	for {
+		select {
+		case <-session.outbox.done:
+			return
+		case frame := <-session.outbox.frames:
+			err := session.Conn.WriteFrame(frame.flags, frame.payload)
+			session.outbox.pending.Add(-1)
+			if err != nil {
+				s.Logger.Log(fmt.Sprintf("Error writing to connection, disconnecting: %s\n", err), logger.ERROR)
+				session.Conn.Close()
+				return
+			}
+		}
+	}
+}
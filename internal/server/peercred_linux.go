@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// Get the user ID of the process on the other side of a Unix socket, using
+// SO_PEERCRED. The kernel records the credentials when the connection is
+// made, so they cannot be forged by the client.
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
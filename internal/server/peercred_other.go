@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// Get the user ID of the process on the other side of a Unix socket. Only
+// Linux is supported, so connections over a Unix socket are rejected on
+// other platforms.
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	return 0, errPeerCredUnsupported
+}
@@ -0,0 +1,38 @@
+package server
+
+import "time"
+
+// Strikes older than this are forgotten, so a client which exceeds the rate
+// limit now and then is never disconnected.
+const strikeWindow = time.Minute
+
+// Check if the client is allowed to send an event of the size, in bytes. The
+// event must be allowed by both the limiter of the connection and the limiter
+// of the device.
+func (session *Session) allow(size int) bool {
+	return session.limiter.Allow(size) && session.deviceLimiter.Allow(size)
+}
+
+// Record that the client exceeded the rate limit. True is returned when the
+// client has exceeded the limit too many times within the strike window and
+// should be disconnected.
+//
+// The time of each strike is kept, and the strikes older than the window are
+// dropped, so every strike expires a minute after it happened. When clients
+// are never disconnected, the strikes are not recorded.
+func (s *TcpServer) strike(session *Session) bool {
+	if s.Opts.MaxStrikes <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	recent := session.strikes[:0]
+	for _, at := range session.strikes {
+		if now.Sub(at) <= strikeWindow {
+			recent = append(recent, at)
+		}
+	}
+	session.strikes = append(recent, now)
+
+	return len(session.strikes) >= s.Opts.MaxStrikes
+}
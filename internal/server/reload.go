@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/pki"
+)
+
+// The files used to build the TLS configuration of the server. The
+// modification times are stored so the watcher can tell when the files
+// have been replaced.
+type tlsFiles struct {
+	certPath string
+	keyPath  string
+	caPath   string
+
+	// Optional, when empty no certificates are revoked.
+	revokedPath string
+
+	modTimes [4]time.Time
+}
+
+// Get the paths of the files, in the same order as the modification times.
+func (f *tlsFiles) paths() [4]string {
+	return [4]string{f.certPath, f.keyPath, f.caPath, f.revokedPath}
+}
+
+// Check the modification times of the files, and report whether any of them
+// have changed since the last check. A file which cannot be read is treated
+// as unchanged, it may be in the middle of being replaced.
+func (f *tlsFiles) changed() bool {
+	changed := false
+	for i, path := range f.paths() {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(f.modTimes[i]) {
+			f.modTimes[i] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Load the certificate, key and CA bundle from disk and build the TLS
+// configuration used for new connections. The leaf certificate is returned
+// so the caller can log its expiry.
+//
+// Client certificates in the revocation list are rejected during the TLS
+// handshake.
+func (s *TcpServer) loadTLSConfig(revoked *pki.RevocationList) (*tls.Config, *x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(s.tlsFiles.certPath, s.tlsFiles.keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	clientCAs, err := pki.LoadCertPool(s.tlsFiles.caPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return verifyNotRevoked(revoked, chains)
+		},
+	}
+	return config, leaf, nil
+}
+
+// ReloadTLS reloads the certificate, key, CA bundle and revocation list from
+// disk. The new configuration is only used for connections made after the
+// reload, the connections which are already open are not affected, unless
+// their certificate has been revoked, in which case they are disconnected.
+//
+// If any of the files cannot be loaded, the error is logged and returned,
+// and the previous configuration is kept. This way a half written file will
+// never take the server offline.
+func (s *TcpServer) ReloadTLS() error {
+	revoked, err := s.loadRevocationList()
+	if err != nil {
+		s.Logger.Log(fmt.Sprintf("Error reloading revocation list, keeping the current certificates: %s\n", err), logger.ERROR)
+		return err
+	}
+
+	config, leaf, err := s.loadTLSConfig(revoked)
+	if err != nil {
+		s.Logger.Log(fmt.Sprintf("Error reloading TLS certificates, keeping the current certificates: %s\n", err), logger.ERROR)
+		return err
+	}
+
+	s.tlsConfig.Store(config)
+	s.Logger.Log(fmt.Sprintf("TLS certificates reloaded, server certificate expires %s\n", leaf.NotAfter.Format(time.RFC3339)))
+
+	s.disconnectRevoked(revoked)
+	return nil
+}
+
+// Watch the TLS files for changes, reloading the configuration when any of
+// them are modified. The files are checked at the interval defined in the
+// server options, and the watcher runs until the server is stopped.
+func (s *TcpServer) watchTLS() {
+	ticker := time.NewTicker(s.Opts.TLSReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.tlsFiles.changed() {
+				s.ReloadTLS()
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/pki"
+)
+
+// Returned by the TLS handshake when the client presents a revoked certificate.
+var errCertificateRevoked = errors.New("client certificate has been revoked")
+
+// Load the revocation list from the path in the server options. When no path
+// is provided, an empty list is used.
+func (s *TcpServer) loadRevocationList() (*pki.RevocationList, error) {
+	if s.tlsFiles.revokedPath == "" {
+		return &pki.RevocationList{}, nil
+	}
+	return pki.LoadRevocationList(s.tlsFiles.revokedPath)
+}
+
+// Check the verified chains of a client certificate against the revocation
+// list. This is used as the VerifyPeerCertificate function of the TLS
+// configuration, so it is only called once the chain has been verified
+// against the CA.
+func verifyNotRevoked(revoked *pki.RevocationList, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		if len(chain) > 0 && revoked.IsRevoked(chain[0]) {
+			return errCertificateRevoked
+		}
+	}
+	return nil
+}
+
+// Close every connection which was made using a revoked certificate. The
+// connections are closed, which causes their HandleConnection goroutine to
+// return and remove them from the server.
+func (s *TcpServer) disconnectRevoked(revoked *pki.RevocationList) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, conn := range s.Conns {
+		if cert := peerCertificate(conn); revoked.IsRevoked(cert) {
+			s.Logger.Log(fmt.Sprintf("Disconnecting revoked device '%s': %s\n", cert.Subject.CommonName, conn.RemoteAddr().String()), logger.WARN)
+			conn.Close()
+		}
+	}
+}
@@ -1,14 +1,24 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
 	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/policy"
+	"github.com/Azpect3120/TCPNotificationManager/internal/ratelimit"
 	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+	"github.com/Azpect3120/TCPNotificationManager/internal/wire"
 )
 
 // Function symbol used to configure the server
@@ -30,6 +40,105 @@ type ServerOpts struct {
 
 	// Size of the message buffer in bytes
 	MsgBufSize int
+
+	// Largest event, in bytes, the server will accept from a client.
+	// Larger events are discarded and an error is sent to the client.
+	MaxEventSize int
+
+	// Optional protocol features the server will enable when
+	// requested by a client during the handshake.
+	Features []string
+
+	// Size in bytes an event must reach before it is compressed,
+	// when compression is enabled for the connection.
+	CompressionThreshold int
+
+	// How often the TLS files are checked for changes. When zero,
+	// the files are only reloaded when ReloadTLS is called.
+	TLSReloadInterval time.Duration
+
+	// Path to the list of revoked client certificates. When empty,
+	// every certificate signed by the CA is trusted.
+	RevocationList string
+
+	// Rate at which each client may send events. The limits apply to each
+	// connection, and to each device across all of its connections.
+	RateLimit ratelimit.Limits
+
+	// Number of times a client may exceed the rate limit, or send an event
+	// over the max event size, within a minute before it is disconnected.
+	// When zero, clients are never disconnected.
+	MaxStrikes int
+
+	// Number of broadcast events which can be waiting to be written to
+	// each client, and what to do when the queue is full.
+	QueueSize   int
+	QueuePolicy QueuePolicy
+
+	// Time allowed for each event to be written to a client. When zero,
+	// writes have no deadline.
+	WriteTimeout time.Duration
+
+	// Time the clients are told to wait before reconnecting when the
+	// server shuts down.
+	ReconnectHint time.Duration
+
+	// Time allowed for the server to shut down once the context passed
+	// to Serve is cancelled.
+	ShutdownTimeout time.Duration
+
+	// Address the HTTP gateway listens on, such as 127.0.0.1:8081. When
+	// empty, the gateway is not started by ListenAndServe.
+	HTTPAddr string
+
+	// Tokens accepted by the HTTP gateway, keyed by the name of the
+	// publisher. The name is used as the sender of the messages, and
+	// as the device name when checking the server's policy.
+	HTTPTokens map[string]string
+
+	// Port the server accepts WebSocket connections on, and the path
+	// of the WebSocket endpoint. When the port is zero, WebSocket
+	// connections are not accepted by ListenAndServe.
+	WebSocketPort int
+	WebSocketPath string
+
+	// Path of the Unix socket the server accepts local connections on,
+	// and the permissions of the socket file. When the path is empty,
+	// the socket is not created by ListenAndServe.
+	UnixSocket     string
+	UnixSocketMode os.FileMode
+
+	// Identities of the users connecting over the Unix socket, keyed by
+	// their user ID. Users which are not listed are identified as
+	// 'unix-<username>'.
+	UnixUsers map[uint32]string
+
+	// Webhooks which receive the messages published to the server, see
+	// the Webhook type for the filters.
+	Webhooks []Webhook
+
+	// Number of times a failed webhook delivery is retried, and the time
+	// allowed for each attempt.
+	WebhookRetries int
+	WebhookTimeout time.Duration
+
+	// Path of the file failed webhook deliveries are appended to, as JSON
+	// lines. When empty, the failures are only logged.
+	WebhookDeadLetter string
+
+	// Generic alert receivers of the HTTP gateway, keyed by the name of
+	// the receiver used in the path, see the AlertMapping type.
+	AlertMappings map[string]AlertMapping
+
+	// Address the SMTP listener listens on, such as 127.0.0.1:2525, and
+	// the mailboxes it accepts email for, keyed by their address. When
+	// the address is empty, the listener is not started.
+	SMTPAddr      string
+	SMTPMailboxes map[string]SMTPMailbox
+
+	// Checks which expect a heartbeat from a scheduled job, keyed by the
+	// name of the check, see the Monitor type.
+	Monitors map[string]Monitor
 }
 
 // Provide an address for the server to bind to.
@@ -67,15 +176,212 @@ func WithMsgBufSize(msgBufSize int) ServerOptsFunc {
 	}
 }
 
+// Provide the largest event, in bytes, the server will accept.
+func WithMaxEventSize(maxEventSize int) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.MaxEventSize = maxEventSize
+	}
+}
+
+// Provide the optional protocol features the server supports. Clients
+// will only be able to enable the features provided here.
+func WithFeatures(features ...string) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.Features = features
+	}
+}
+
+// Provide the size in bytes an event must reach before it is compressed.
+func WithCompressionThreshold(threshold int) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.CompressionThreshold = threshold
+	}
+}
+
+// Provide how often the TLS files are checked for changes. Use zero
+// to disable the watcher.
+func WithTLSReloadInterval(interval time.Duration) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.TLSReloadInterval = interval
+	}
+}
+
+// Provide the path to the list of revoked client certificates, which
+// is created by the 'tnm pki revoke' command.
+func WithRevocationList(path string) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.RevocationList = path
+	}
+}
+
+// Provide the rate at which each client may send events. Use zero for
+// a rate to disable that limit.
+func WithRateLimit(limits ratelimit.Limits) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.RateLimit = limits
+	}
+}
+
+// Provide the number of times a client may exceed the rate limit within
+// a minute before it is disconnected.
+func WithMaxStrikes(maxStrikes int) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.MaxStrikes = maxStrikes
+	}
+}
+
+// Provide the size of the outbound queue of each client, and what to do
+// when the queue is full.
+func WithQueue(size int, policy QueuePolicy) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.QueueSize = size
+		opts.QueuePolicy = policy
+	}
+}
+
+// Provide the time allowed for each event to be written to a client.
+func WithWriteTimeout(timeout time.Duration) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.WriteTimeout = timeout
+	}
+}
+
+// Provide the time the clients are told to wait before reconnecting when
+// the server shuts down.
+func WithReconnectHint(hint time.Duration) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.ReconnectHint = hint
+	}
+}
+
+// Provide the time allowed for the server to shut down once the context
+// passed to Serve is cancelled.
+func WithShutdownTimeout(timeout time.Duration) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.ShutdownTimeout = timeout
+	}
+}
+
+// Provide the address for the HTTP gateway to listen on, and the tokens it
+// accepts keyed by the name of the publisher.
+func WithHTTPGateway(addr string, tokens map[string]string) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.HTTPAddr = addr
+		opts.HTTPTokens = tokens
+	}
+}
+
+// Provide the port and path the server accepts WebSocket connections on. The
+// connections use TLS when the server does.
+func WithWebSocket(port int, path string) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.WebSocketPort = port
+		opts.WebSocketPath = path
+	}
+}
+
+// Provide the path of the Unix socket the server accepts local connections on,
+// and the permissions of the socket file. Only the users which can write to the
+// socket are able to connect.
+func WithUnixSocket(path string, mode os.FileMode) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.UnixSocket = path
+		opts.UnixSocketMode = mode
+	}
+}
+
+// Provide the identities of the users connecting over the Unix socket, keyed
+// by their user ID.
+func WithUnixUsers(users map[uint32]string) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.UnixUsers = users
+	}
+}
+
+// Provide the webhooks which receive the messages published to the server.
+func WithWebhooks(webhooks ...Webhook) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.Webhooks = webhooks
+	}
+}
+
+// Provide the number of times a failed webhook delivery is retried, and the
+// time allowed for each attempt.
+func WithWebhookRetries(retries int, timeout time.Duration) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.WebhookRetries = retries
+		opts.WebhookTimeout = timeout
+	}
+}
+
+// Provide the path of the file failed webhook deliveries are appended to.
+func WithWebhookDeadLetter(path string) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.WebhookDeadLetter = path
+	}
+}
+
+// Provide the generic alert receivers of the HTTP gateway, keyed by the name
+// of the receiver.
+func WithAlertMappings(mappings map[string]AlertMapping) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.AlertMappings = mappings
+	}
+}
+
+// Provide the address for the SMTP listener to listen on, and the mailboxes
+// it accepts email for keyed by their address.
+func WithSMTP(addr string, mailboxes map[string]SMTPMailbox) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.SMTPAddr = addr
+		opts.SMTPMailboxes = mailboxes
+	}
+}
+
+// Provide the checks which expect a heartbeat from a scheduled job, keyed by
+// the name of the check.
+func WithMonitors(monitors map[string]Monitor) ServerOptsFunc {
+	return func(opts *ServerOpts) {
+		opts.Monitors = monitors
+	}
+}
+
 // Defines the default server options, if they are not
 // provided by the user.
 func defaultServerOpts() ServerOpts {
 	return ServerOpts{
-		Addr:       "127.0.0.1",
-		Port:       8080,
-		TLS:        false,
-		MaxConn:    10,
-		MsgBufSize: 1024,
+		Addr:         "127.0.0.1",
+		Port:         8080,
+		TLS:          false,
+		MaxConn:      10,
+		MsgBufSize:   1024,
+		MaxEventSize: wire.DefaultMaxFrameSize,
+		Features:     events.SupportedFeatures(),
+
+		CompressionThreshold: wire.DefaultCompressionThreshold,
+		TLSReloadInterval:    10 * time.Second,
+
+		RateLimit: ratelimit.Limits{
+			MessagesPerSec: 10,
+			MessageBurst:   20,
+			BytesPerSec:    256 * 1024,
+			ByteBurst:      wire.DefaultMaxFrameSize,
+		},
+		MaxStrikes: 10,
+
+		QueueSize:    64,
+		QueuePolicy:  DropOldest,
+		WriteTimeout: 10 * time.Second,
+
+		ReconnectHint:   5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+
+		WebSocketPath: "/ws",
+
+		UnixSocketMode: 0660,
+
+		WebhookRetries: 5,
+		WebhookTimeout: 10 * time.Second,
 	}
 }
 
@@ -123,12 +429,60 @@ type TcpServer struct {
 	// connection.
 	Authorized map[string]net.Conn
 
+	// The state of each connection to the server. The connection is the
+	// key, which will be the framed connection created by HandleConnection
+	// and passed to the event handlers.
+	Sessions map[net.Conn]*Session
+
+	// Rate limiters for each device, shared by all of the connections
+	// made by the device.
+	limiters map[string]*ratelimit.Limiter
+
+	// Protects the Conns, Authorized, Sessions and limiters fields, which
+	// are used by the goroutine of every connection.
+	mu sync.RWMutex
+
 	// Store any errors that occur during the server's lifecycle.
 	Errors []error
 
-	// TLS configuration for the server.
+	// TLS configuration for the server. The certificates are not stored
+	// here, the configuration for each connection is provided by the
+	// GetConfigForClient function so the certificates can be reloaded.
 	TLSConfig *tls.Config
 
+	// The TLS configuration used for new connections, replaced each time
+	// the certificates are reloaded.
+	tlsConfig atomic.Pointer[tls.Config]
+
+	// The files the TLS configuration is loaded from.
+	tlsFiles tlsFiles
+
+	// Closed when the server is stopped, which stops the goroutines
+	// started by the server.
+	done chan struct{}
+
+	// Listeners created by Listen, which are closed by Shutdown.
+	listeners []net.Listener
+
+	// Set once Shutdown is called, new connections are rejected.
+	draining atomic.Bool
+
+	// Closed once Shutdown has finished.
+	stopped chan struct{}
+
+	// HTTP gateway started by ListenAndServe, which is stopped by Shutdown.
+	httpServer *http.Server
+
+	// Workers which deliver the published messages to the webhooks.
+	webhooks webhookDispatcher
+
+	// Connections to the SMTP listener, which are closed by Shutdown.
+	smtp smtpListener
+
+	// State of the checks, which are watched for missed heartbeats until
+	// the server is shut down.
+	monitors monitorSet
+
 	// EventHandlers is a map of event types to their handlers. This map
 	// will be used to determine which function to call when an event is
 	// received by the server.
@@ -140,6 +494,13 @@ type TcpServer struct {
 
 	// Logger for the server, the default option will be info level.
 	Logger *logger.Logger
+
+	// Policy which grants permissions to each device. By default, every
+	// device is allowed to do everything, see ConfigurePolicy.
+	Policy *policy.Policy
+
+	// Counters tracked over the lifetime of the server.
+	Metrics Metrics
 }
 
 // RegisterEventHandler registers an event handler for a specific event type.
@@ -158,9 +519,12 @@ func RegisterEventHandler[T any](server *TcpServer, eventName string, handler Ev
 // be found in the defaultServerOpts function.
 func NewTCPServer(opts ...ServerOptsFunc) *TcpServer {
 	server := &TcpServer{
-		Opts:   defaultServerOpts(),
-		ID:     utils.GenerateServerID(),
-		Logger: logger.NewLogger(logger.WithDefaultLevel(logger.INFO), logger.WithTimestamp()),
+		Opts:    defaultServerOpts(),
+		ID:      utils.GenerateServerID(),
+		Logger:  logger.NewLogger(logger.WithDefaultLevel(logger.INFO), logger.WithTimestamp()),
+		Policy:  policy.AllowAll(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 
 	// Apply the options to the server.
@@ -174,6 +538,32 @@ func NewTCPServer(opts ...ServerOptsFunc) *TcpServer {
 	// limit.
 	server.Conns = make([]net.Conn, 0, server.Opts.MaxConn)
 	server.Authorized = make(map[string]net.Conn)
+	server.Sessions = make(map[net.Conn]*Session)
+	server.limiters = make(map[string]*ratelimit.Limiter)
+
+	// Invalid webhooks, alert mappings, mailboxes and monitors are returned by
+	// ListenAndServe, like the errors stored by Configure.
+	for _, hook := range server.Opts.Webhooks {
+		if err := hook.validate(); err != nil {
+			server.Errors = append(server.Errors, err)
+		}
+	}
+	for receiver, mapping := range server.Opts.AlertMappings {
+		if mapping.Message == "" {
+			server.Errors = append(server.Errors, fmt.Errorf("alert receiver '%s' does not have a message path", receiver))
+		}
+	}
+	for address, mailbox := range server.Opts.SMTPMailboxes {
+		if !events.IsValidPriority(mailbox.Priority) {
+			server.Errors = append(server.Errors, fmt.Errorf("invalid priority '%s' for mailbox '%s'", mailbox.Priority, address))
+		}
+	}
+	for name, monitor := range server.Opts.Monitors {
+		if err := monitor.validate(); err != nil {
+			server.Errors = append(server.Errors, fmt.Errorf("invalid monitor '%s': %w", name, err))
+		}
+	}
+	server.initMonitors()
 
 	// Initialize the event handlers map
 	server.EventHandlers = make(map[string]interface{})
@@ -182,9 +572,12 @@ func NewTCPServer(opts ...ServerOptsFunc) *TcpServer {
 	// of the event. They must be a perfect match or the event will not be handled.
 	// The 3rd parameter (handler) is the function that will be called when the event
 	// is received by the server.
+	RegisterEventHandler(server, "HelloEvent", HelloHandler)
 	RegisterEventHandler(server, "RequestAuthenticationEvent", RequestAuthenticationHandler)
 	RegisterEventHandler(server, "ClientDisconnectingEvent", ClientDisconnectingHandler)
 	RegisterEventHandler(server, "SendMessageEvent", SendMessageHandler)
+	RegisterEventHandler(server, "KickClientEvent", KickClientHandler)
+	RegisterEventHandler(server, "HeartbeatEvent", HeartbeatHandler)
 
 	return server
 }
@@ -193,34 +586,68 @@ func NewTCPServer(opts ...ServerOptsFunc) *TcpServer {
 // It is only required if you intend to use TLS, otherwise, there is no
 // need to run this function.
 //
+// The CA certificate is used to verify the client certificates, every client
+// must present a certificate signed by the CA. The certificates can be created
+// using the 'tnm pki' command. Certificates in the revocation list provided in
+// the server options are rejected, even though they are signed by the CA.
+//
+// The files are watched for changes, and reloaded without restarting the server
+// when they are replaced. See the ReloadTLS function for more details.
+//
 // The server is returned to allow for method chaining.
 //
 // Errors will not be handled here, they will be stored in the server's
 // errors slice. If the files do not exist, or cannot be read, an error
 // will be stored in the server's errors slice.
-func (s *TcpServer) Configure(certPath, keyPath string) *TcpServer {
-	// Ensure the files exist
-	if _, err := os.OpenFile(certPath, os.O_RDONLY, 0644); err != nil {
+func (s *TcpServer) Configure(certPath, keyPath, caPath string) *TcpServer {
+	s.tlsFiles = tlsFiles{certPath: certPath, keyPath: keyPath, caPath: caPath, revokedPath: s.Opts.RevocationList}
+	s.tlsFiles.changed()
+
+	if revoked, err := s.loadRevocationList(); err != nil {
 		s.Errors = append(s.Errors, err)
-	}
-	if _, err := os.OpenFile(keyPath, os.O_RDONLY, 0644); err != nil {
+	} else if config, leaf, err := s.loadTLSConfig(revoked); err != nil {
 		s.Errors = append(s.Errors, err)
+	} else {
+		s.tlsConfig.Store(config)
+		s.Logger.Log(fmt.Sprintf("TLS certificates loaded, server certificate expires %s\n", leaf.NotAfter.Format(time.RFC3339)), logger.DEBUG)
 	}
 
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		s.Errors = append(s.Errors, err)
+	// Each connection uses the most recently loaded configuration. Until the
+	// certificates have been loaded, every TLS handshake will fail.
+	s.TLSConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if config := s.tlsConfig.Load(); config != nil {
+				return config, nil
+			}
+			return nil, fmt.Errorf("TLS certificates have not been loaded")
+		},
 	}
 
-	// TODO: Switch these values to correct production values
-	s.TLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		// Verifying isn't working right now, need to get certs signed by CA
-		//ClientAuth:         tls.RequestClientCert, // Use tls.RequireAndVerifyClientCert for production and security
-		ClientAuth:         tls.RequireAndVerifyClientCert, // Use tls.RequireAndVerifyClientCert for production and security
-		InsecureSkipVerify: false,                          // ONLY FOR TESTING - NEVER IN PRODUCTION
+	if s.Opts.TLSReloadInterval > 0 {
+		go s.watchTLS()
+	}
+
+	return s
+}
+
+// ConfigurePolicy loads the policy which grants permissions to each device
+// from a JSON file, see the policy package for the format of the file. If
+// this function is not called, every device is allowed to do everything.
+//
+// The permissions of a device are determined when it connects, so this must
+// be called before the server starts accepting connections.
+//
+// The server is returned to allow for method chaining. If the policy cannot
+// be loaded, the error is stored in the server's errors slice.
+func (s *TcpServer) ConfigurePolicy(path string) *TcpServer {
+	p, err := policy.Load(path)
+	if err != nil {
+		s.Errors = append(s.Errors, err)
+		return s
 	}
 
+	s.Policy = p
 	return s
 }
 
@@ -239,21 +666,214 @@ func (s *TcpServer) Listen() net.Listener {
 	var err error
 
 	if s.Opts.TLS && s.TLSConfig != nil {
-		ln, err = tls.Listen("tcp", fmt.Sprintf("%s:%d", s.Opts.Addr, s.Opts.Port), s.TLSConfig)
+		ln, err = tls.Listen("tcp", net.JoinHostPort(s.Opts.Addr, strconv.Itoa(s.Opts.Port)), s.TLSConfig)
 	} else {
-		ln, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.Opts.Addr, s.Opts.Port))
+		ln, err = net.Listen("tcp", net.JoinHostPort(s.Opts.Addr, strconv.Itoa(s.Opts.Port)))
 	}
 
 	if err != nil {
 		s.Errors = append(s.Errors, err)
+		return ln
 	}
+
+	s.trackListener(ln)
 	return ln
 }
 
+// ListenAndServe listens on the address and port in the server options, and
+// serves the connections until the context is cancelled, see Serve. Unlike
+// Listen, errors are returned instead of being stored in the server's errors
+// slice.
+//
+// Any errors stored by Configure or ConfigurePolicy are returned before the
+// server starts listening. When TLS is enabled in the server options, Configure
+// must have been called, the server will never fall back to plain TCP.
+//
+// When the HTTP address is set in the server options, the HTTP gateway is also
+// started, and is stopped along with the server. When the WebSocket port is
+// set, WebSocket connections are accepted on that port, and are handled the
+// same as the TCP connections. When the Unix socket is set, local connections
+// are accepted on the socket, and are identified by the user which connected.
+// When the SMTP address is set, the SMTP listener is started.
+//
+// If any of the listeners fails to start, the ones which were already started
+// are stopped by shutting down the server before the error is returned.
+func (s *TcpServer) ListenAndServe(ctx context.Context) error {
+	if len(s.Errors) > 0 {
+		return errors.Join(s.Errors...)
+	}
+
+	if s.Opts.TLS && s.TLSConfig == nil {
+		return errors.New("TLS is enabled but the server has not been configured")
+	}
+
+	ln, err := s.listen(s.Opts.Port)
+	if err != nil {
+		return err
+	}
+
+	if s.Opts.WebSocketPort != 0 {
+		wsLn, err := s.listen(s.Opts.WebSocketPort)
+		if err != nil {
+			return s.abortListen(ln, err)
+		}
+
+		// Both listeners are closed by Shutdown, the error returned once
+		// the server has shut down is returned by the TCP listener below.
+		go func() {
+			if err := s.Serve(ctx, wire.NewWebSocketListener(wsLn, s.Opts.WebSocketPath)); !errors.Is(err, ErrServerClosed) {
+				s.Logger.Log(fmt.Sprintf("Error accepting WebSocket connections: %s\n", err), logger.ERROR)
+			}
+		}()
+		s.Logger.Log(fmt.Sprintf("Accepting WebSocket connections on %s%s\n", wsLn.Addr(), s.Opts.WebSocketPath))
+	}
+
+	if s.Opts.UnixSocket != "" {
+		unixLn, err := s.listenUnix()
+		if err != nil {
+			return s.abortListen(ln, err)
+		}
+
+		go func() {
+			if err := s.Serve(ctx, unixLn); !errors.Is(err, ErrServerClosed) {
+				s.Logger.Log(fmt.Sprintf("Error accepting Unix socket connections: %s\n", err), logger.ERROR)
+			}
+		}()
+		s.Logger.Log(fmt.Sprintf("Accepting local connections on %s\n", s.Opts.UnixSocket))
+	}
+
+	if s.Opts.HTTPAddr != "" {
+		if err := s.startGateway(); err != nil {
+			return s.abortListen(ln, err)
+		}
+	}
+
+	if s.Opts.SMTPAddr != "" {
+		if err := s.startSMTP(); err != nil {
+			return s.abortListen(ln, err)
+		}
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Stop everything ListenAndServe started before it failed, so a server which
+// could not start is not left serving on some of its listeners. The listener
+// has not been passed to Serve yet, so it is closed here, the others are
+// closed by Shutdown. The error is returned so it can be passed through.
+func (s *TcpServer) abortListen(ln net.Listener, err error) error {
+	ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	if shutdownErr := s.Shutdown(ctx); shutdownErr != nil && !errors.Is(shutdownErr, ErrServerClosed) {
+		s.Logger.Log(fmt.Sprintf("Error shutting down server: %s\n", shutdownErr), logger.ERROR)
+	}
+	return err
+}
+
+// Listen on the address in the server options and the port, using TLS when
+// it is enabled in the server options.
+func (s *TcpServer) listen(port int) (net.Listener, error) {
+	addr := net.JoinHostPort(s.Opts.Addr, strconv.Itoa(port))
+	if s.Opts.TLS {
+		return tls.Listen("tcp", addr, s.TLSConfig)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve accepts connections on the listener and handles each one in its own
+// goroutine, until the context is cancelled or the server is shut down. The
+// listener is owned by the server from here on, and is closed by Shutdown.
+//
+// When the context is cancelled, the server is shut down, allowing up to the
+// shutdown timeout in the server options for the clients to receive their
+// queued events. Serve always returns a non-nil error. Once the server has
+// been shut down, by the context or a call to Shutdown, ErrServerClosed is
+// returned.
+//
+// Errors while accepting connections are retried with a backoff. If the
+// listener is closed by something other than Shutdown, the error is returned
+// and the server keeps serving the connected clients.
+func (s *TcpServer) Serve(ctx context.Context, ln net.Listener) error {
+	if err := s.trackListener(ln); err != nil {
+		return err
+	}
+	s.startMonitors()
+
+	// Shut down the server once the context is cancelled, the goroutine
+	// stops when Serve returns.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-stop:
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Opts.ShutdownTimeout)
+			defer cancel()
+			if err := s.Shutdown(shutdownCtx); err != nil && !errors.Is(err, ErrServerClosed) {
+				s.Logger.Log(fmt.Sprintf("Error shutting down server: %s\n", err), logger.ERROR)
+			}
+		}
+	}()
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.draining.Load() {
+				// Wait for the shutdown to finish before returning, so the
+				// caller knows every connection has been closed.
+				<-s.stopped
+				return ErrServerClosed
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Errors such as running out of file descriptors are usually
+			// temporary, so the listener is retried with a backoff.
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			s.Logger.Log(fmt.Sprintf("Error accepting connection, retrying in %s: %s\n", backoff, err), logger.ERROR)
+			time.Sleep(backoff)
+			continue
+		}
+
+		backoff = 0
+		go s.HandleConnection(conn)
+	}
+}
+
+// Track a listener so it is closed by Shutdown. If the server has already
+// been shut down, the listener is closed and ErrServerClosed is returned.
+func (s *TcpServer) trackListener(ln net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining.Load() {
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, ln)
+	return nil
+}
+
 // Add a connection to the server. This function does not authenticate the
 // client, but it does allow the server to track the connection. If the server
 // is at the max connection limit, the server will return an error.
-func (s *TcpServer) addConnection(conn net.Conn) error {
+//
+// A session is created for the connection, which will hold the state of the
+// connection until it is removed. The device is the identity of the client,
+// taken from its certificate.
+func (s *TcpServer) addConnection(conn *wire.Conn, device string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Once the server is shutting down, no more connections are tracked.
+	if s.draining.Load() {
+		return ErrServerClosed
+	}
+
 	// At max size, return an error. The error will be used to send back a connection_rejected
 	// message to the client.
 	if len(s.Conns) >= s.Opts.MaxConn {
@@ -261,6 +881,17 @@ func (s *TcpServer) addConnection(conn net.Conn) error {
 	}
 
 	s.Conns = append(s.Conns, conn)
+	session := newSession(conn, device, s.Policy.Permissions(device))
+	session.outbox = newOutbox(s.Opts.QueueSize)
+	session.limiter = ratelimit.NewLimiter(s.Opts.RateLimit)
+	if device != "" {
+		if _, ok := s.limiters[device]; !ok {
+			s.limiters[device] = ratelimit.NewLimiter(s.Opts.RateLimit)
+		}
+		session.deviceLimiter = s.limiters[device]
+	}
+
+	s.Sessions[conn] = session
 	return nil
 }
 
@@ -269,6 +900,13 @@ func (s *TcpServer) addConnection(conn net.Conn) error {
 // server's connection slice. It will not remove the connection from the authorized
 // map. This is because clients can be connected that aren't authorized.
 func (s *TcpServer) removeConnection(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.Sessions[conn]; ok {
+		session.outbox.close()
+	}
+	delete(s.Sessions, conn)
 	for i, c := range s.Conns {
 		if c == conn {
 			s.Conns = append(s.Conns[:i], s.Conns[i+1:]...)
@@ -281,42 +919,138 @@ func (s *TcpServer) removeConnection(conn net.Conn) {
 // This function will be used to send messages to all clients that are authenticated,
 // those that are not authenticated will not receive the message.
 //
-// The message should be built before this function is called, typically a JSON
-// marshalled byte slice.
+// The event is encoded for each client using the codec negotiated with that client,
+// each codec is only used to encode the event once.
 //
-// This function has an O(n^2) time complexity, which is not ideal, but it is to
-// ensure safety and security. This function will loop over the authorized map
-// and then loop over the connections slice to ensure the client is still connected.
+// This function will loop over the authorized map and check the connections slice
+// to ensure the client is still connected.
 //
-// However, to optimize this function, go routines have been used to send the messages
-// all at the same time. A mutex must be used for the errs slice to prevent race
-// conditions.
+// The event is not written to the clients here, instead it is added to the outbound
+// queue of each client, which is written by the writer goroutine of the connection.
+// This way a slow client is never able to block the broadcast. When the queue of a
+// client is full, the queue policy in the server options decides what happens.
 //
-// A slice of errors will be returned to the caller. If there are no errors, the slice
-// will be empty. Otherwise, the slice will contain all errors that occurred during
-// the broadcast, which will only be errors that occurred while sending the message.
+// The number of clients the message was queued for is returned along with a slice
+// of errors. If there are no errors, the slice will be empty. Otherwise, the slice
+// will contain all errors that occurred during the broadcast, which will be errors
+// that occurred while encoding the message, or queuing it for a client.
 //
 // The ignore parameter is used to ignore a connection from the broadcast. This is useful
 // when a client sends a message and does not want to receive the message back.
-func (s *TcpServer) BroadcastMessage(message []byte, ignore ...net.Conn) []error {
+//
+// Clients which were not granted the subscribe permission by the server's policy will
+// not receive the message.
+func (s *TcpServer) BroadcastMessage(event interface{}, ignore ...net.Conn) (int, []error) {
 	var errs []error
-	var mu sync.Mutex
-	var wg sync.WaitGroup
+	var delivered int
+
+	// The encoded event for each codec, shared by the clients using it.
+	payloads := make(map[events.Codec][]byte)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	for _, conn := range s.Authorized {
-		wg.Add(1)
-		go func(conn net.Conn) {
-			defer wg.Done()
-			if utils.Contains(s.Conns, conn) && !utils.Contains(ignore, conn) {
-				if _, err := conn.Write(message); err != nil {
-					mu.Lock()
-					errs = append(errs, err)
-					mu.Unlock()
-				}
+		session := s.Sessions[conn]
+		if !utils.Contains(s.Conns, conn) || utils.Contains(ignore, conn) || !session.HasPermission(policy.Subscribe) {
+			continue
+		}
+
+		codec := session.Conn.Codec()
+		payload, ok := payloads[codec]
+		if !ok {
+			var err error
+			if payload, err = codec.Marshal(event); err != nil {
+				errs = append(errs, err)
+				continue
 			}
-		}(conn)
+			payloads[codec] = payload
+		}
+
+		if err := s.enqueue(session, outFrame{flags: wire.CodecFlags(codec), payload: payload}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delivered++
 	}
 
-	wg.Wait()
-	return errs
+	return delivered, errs
+}
+
+var (
+	// ErrInvalidPriority is returned by Publish when the priority of the
+	// message is not one of the priorities in the events package.
+	ErrInvalidPriority = errors.New("invalid priority")
+
+	// ErrBroadcastFailed is returned by Publish when the message could not
+	// be queued for any of the clients.
+	ErrBroadcastFailed = errors.New("message could not be broadcast")
+)
+
+// Publish broadcasts a message to every authenticated client with the subscribe
+// permission, except the ignored connections. This is the path shared by every
+// way a message can be published, such as the send_message event and the HTTP
+// gateway, the caller is responsible for checking the publisher is allowed to
+// publish.
+//
+// The sender is the ID of the client, or the name of the publisher when the
+// message did not come from a client. The number of clients the message was
+// queued for is returned. Errors which occur for individual clients are logged,
+// an error is only returned when the message is invalid, or it could not be
+// queued for any client.
+func (s *TcpServer) Publish(sender string, message events.SendMessageContent, ignore ...net.Conn) (int, error) {
+	if !events.IsValidPriority(message.Priority) {
+		return 0, fmt.Errorf("%w: '%s'", ErrInvalidPriority, message.Priority)
+	}
+
+	event := events.NewBroadcastMessageEvent(s.ID, sender, message.Message)
+	event.Content.Title = message.Title
+	event.Content.Topic = message.Topic
+	event.Content.Priority = message.Priority
+
+	delivered, errs := s.BroadcastMessage(event, ignore...)
+	for _, err := range errs {
+		s.Logger.Log(fmt.Sprintf("Error broadcasting message: %s\n", err), logger.ERROR)
+	}
+
+	// The webhooks receive the message whether or not any client did.
+	s.dispatchWebhooks(event)
+
+	// The message only failed when it could not be delivered to any client,
+	// having no clients to deliver to is not an error.
+	if delivered == 0 && len(errs) > 0 {
+		return 0, ErrBroadcastFailed
+	}
+	return delivered, nil
+}
+
+// Send encodes the event and writes it to a single connection as a frame. This should
+// be used for every event sent directly to a client, instead of encoding and
+// writing the event in the handlers. The event is encoded with the codec which
+// was negotiated with the client.
+//
+// The error is returned to the caller, it is up to the caller to decide if
+// the error should be logged or ignored.
+func (s *TcpServer) Send(conn net.Conn, event interface{}) error {
+	return wire.Wrap(conn).WriteEvent(event)
+}
+
+// Reply sends an event to a client in response to a request. The request ID
+// of the request is copied into the event, so the client can correlate the
+// response with the request it sent.
+func (s *TcpServer) Reply(conn net.Conn, request events.BaseEvent, event events.Event) error {
+	event.Base().RequestID = request.RequestID
+	return s.Send(conn, event)
+}
+
+// SendError sends an ErrorEvent back to the client when an event could not
+// be handled. The request is the base of the event which caused the error,
+// which allows the client to correlate the error with the request.
+//
+// The codes are defined in the events package, and the reason should follow
+// the "Short Reason: Description" format used by the other events.
+func (s *TcpServer) SendError(conn net.Conn, code int, reason string, request events.BaseEvent) {
+	if err := s.Send(conn, events.NewErrorEvent(s.ID, code, reason, request)); err != nil {
+		s.Logger.Log(fmt.Sprintf("Error sending error event: %s\n", err), logger.ERROR)
+	}
 }
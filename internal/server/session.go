@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/policy"
+	"github.com/Azpect3120/TCPNotificationManager/internal/ratelimit"
+	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+	"github.com/Azpect3120/TCPNotificationManager/internal/wire"
+)
+
+// Session stores the state of a single connection to the server. A session
+// is created for every connection, whether or not the client has completed
+// the handshake or authenticated.
+//
+// The version and features are set once the handshake is complete, until
+// then the version is zero and the client may only send the hello event.
+type Session struct {
+	// The framed connection to the client.
+	Conn *wire.Conn
+
+	// Name of the device, taken from the certificate the client presented
+	// during the TLS handshake. Empty when the server does not use TLS.
+	Device string
+
+	// Permissions granted to the device by the server's policy.
+	Permissions []policy.Permission
+
+	// Protocol version negotiated during the handshake.
+	Version int
+
+	// Optional features enabled during the handshake.
+	Features []string
+
+	// Events waiting to be written to the client.
+	outbox *outbox
+
+	// Rate limiters for the connection, and for the device which is
+	// shared with its other connections. The device limiter is nil when
+	// the server does not use TLS.
+	limiter       *ratelimit.Limiter
+	deviceLimiter *ratelimit.Limiter
+
+	// When the client exceeded the rate limit within the strike window,
+	// oldest first. Only used by the goroutine of the connection.
+	strikes []time.Time
+}
+
+// Create a new session for the connection. The handshake has not been
+// completed, so no features are enabled.
+func newSession(conn *wire.Conn, device string, permissions []policy.Permission) *Session {
+	return &Session{
+		Conn:        conn,
+		Device:      device,
+		Permissions: permissions,
+		Version:     0,
+		Features:    []string{},
+	}
+}
+
+// Check if the client has completed the handshake.
+func (s *Session) HasHandshake() bool {
+	return s != nil && s.Version != 0
+}
+
+// Check if a feature was enabled during the handshake. This is safe to call
+// on a nil session, which has no features.
+func (s *Session) HasFeature(feature string) bool {
+	return s != nil && utils.Contains(s.Features, feature)
+}
+
+// Check if the device was granted a permission by the server's policy. This
+// is safe to call on a nil session, which has no permissions.
+func (s *Session) HasPermission(permission policy.Permission) bool {
+	return s != nil && utils.Contains(s.Permissions, permission)
+}
+
+// Get the session for a connection. If the connection is not tracked by the
+// server, nil is returned.
+func (s *TcpServer) session(conn net.Conn) *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Sessions[conn]
+}
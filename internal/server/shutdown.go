@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/wire"
+)
+
+// ErrServerClosed is returned by Shutdown when the server has already been
+// shut down.
+var ErrServerClosed = errors.New("server has been shut down")
+
+// How often Shutdown checks if the queues have been flushed and the
+// connections have closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Time allowed to stop the listeners started by ListenAndServe when a later
+// one fails to start. There are no clients to flush at that point, so it is
+// kept short.
+const abortTimeout = time.Second
+
+// Shutdown stops the server gracefully. The server stops accepting new
+// connections, and every connected client is sent the server_shutting_down
+// event, which tells it when to reconnect. Once the outbound queue of every
+// client has been flushed, the connections are closed.
+//
+// The clients can keep sending events while their queues are flushed, but
+// new connections are rejected.
+//
+// If the context expires before the queues are flushed, the connections are
+// closed straight away and the error of the context is returned. If the
+// context expires before the connections have been removed, the error is
+// also returned, but the connections have already been closed.
+//
+// Serve returns ErrServerClosed once Shutdown has finished.
+func (s *TcpServer) Shutdown(ctx context.Context) error {
+	if !s.draining.CompareAndSwap(false, true) {
+		return ErrServerClosed
+	}
+	defer close(s.stopped)
+
+	s.Logger.Log("Server is shutting down\n")
+
+	// Stop accepting connections, and stop the goroutines started by the
+	// server, such as the TLS watcher.
+	s.mu.Lock()
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.listeners = nil
+	s.mu.Unlock()
+	close(s.done)
+
+	// Let the requests to the HTTP gateway finish, new requests are
+	// rejected while the server is draining.
+	if err := s.stopGateway(ctx); err != nil {
+		s.Logger.Log(fmt.Sprintf("Error stopping HTTP gateway: %s\n", err), logger.ERROR)
+	}
+	s.stopSMTP()
+
+	s.notifyShutdown()
+
+	// Wait for the queues to flush, the context error is only returned
+	// once the connections have been closed.
+	err := s.waitFor(ctx, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for _, session := range s.Sessions {
+			if !session.outbox.flushed() {
+				return false
+			}
+		}
+		return true
+	})
+
+	s.mu.RLock()
+	for _, conn := range s.Conns {
+		conn.Close()
+	}
+	s.mu.RUnlock()
+
+	// Let the webhook deliveries in progress finish, the deliveries which
+	// have not been made when the context expires are dead lettered.
+	if err := s.stopWebhooks(ctx); err != nil {
+		s.Logger.Log(fmt.Sprintf("Error stopping webhooks: %s\n", err), logger.ERROR)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Each connection is removed by its own goroutine once it sees the
+	// connection has been closed.
+	return s.waitFor(ctx, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return len(s.Conns) == 0
+	})
+}
+
+// Add the server_shutting_down event to the outbound queue of every client
+// which has completed the handshake, whether or not it has authenticated.
+func (s *TcpServer) notifyShutdown() {
+	event := events.NewServerShuttingDownEvent(s.ID, "Server Shutting Down: Server is restarting or stopping", s.Opts.ReconnectHint)
+	payloads := make(map[events.Codec][]byte)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, session := range s.Sessions {
+		if !session.HasHandshake() {
+			continue
+		}
+
+		codec := session.Conn.Codec()
+		payload, ok := payloads[codec]
+		if !ok {
+			var err error
+			if payload, err = codec.Marshal(event); err != nil {
+				s.Logger.Log(fmt.Sprintf("Error encoding shutdown event: %s\n", err), logger.ERROR)
+				continue
+			}
+			payloads[codec] = payload
+		}
+
+		if err := s.enqueue(session, outFrame{flags: wire.CodecFlags(codec), payload: payload}); err != nil {
+			s.Logger.Log(fmt.Sprintf("Error sending shutdown event: %s\n", err), logger.ERROR)
+		}
+	}
+}
+
+// Wait until the condition is true, or the context expires.
+func (s *TcpServer) waitFor(ctx context.Context, condition func() bool) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/policy"
+	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+)
+
+// Programs which can only send email, such as cron jobs and appliances, can
+// publish messages through a minimal SMTP listener. Each email sent to one of
+// the mailboxes in the server options is published as a message, the subject
+// is the title and the text of the body is the message.
+//
+// The listener only implements what is needed to receive mail from a local
+// sender, there is no authentication or TLS, so it should only listen on a
+// trusted interface. Mail to other addresses is rejected, the server is never
+// an open relay.
+
+// Time allowed for the sender to send each command, and the whole message
+// once the DATA command has been accepted.
+const smtpTimeout = 5 * time.Minute
+
+// Largest email accepted by the listener, including the headers and any
+// attachments, which are discarded.
+const smtpMaxMessageSize = 10 << 20
+
+// Max recipients accepted for a single email.
+const smtpMaxRecipients = 100
+
+// Max length of the text published for an email, longer text is truncated.
+const smtpMaxTextSize = 16 << 10
+
+// Matches the tags of an HTML body, which are removed when there is no text
+// version of the body.
+var htmlTag = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// SMTPMailbox is an address which receives email on the SMTP listener. Each
+// email sent to the mailbox is published as a message.
+type SMTPMailbox struct {
+	// Name of the publisher, which is used as the sender of the messages
+	// and must have the publish permission in the server's policy. When
+	// empty, the address of the mailbox is used.
+	Publisher string `json:"publisher"`
+
+	// Topic of the messages, and their priority when the email does not
+	// have a priority header.
+	Topic    string `json:"topic"`
+	Priority string `json:"priority"`
+}
+
+// The SMTP listener and its connections, which are closed by Shutdown.
+type smtpListener struct {
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+}
+
+// The state of a single SMTP connection, which is reset after each email.
+type smtpSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	helo   bool
+	mail   bool
+	from   string
+	rcpts  []string
+}
+
+// Start the SMTP listener on the SMTP address in the server options. The
+// listener and its connections are closed by Shutdown.
+func (s *TcpServer) startSMTP() error {
+	ln, err := net.Listen("tcp", s.Opts.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	if err := s.trackListener(ln); err != nil {
+		ln.Close()
+		return err
+	}
+
+	s.smtp.mu.Lock()
+	s.smtp.ln = ln
+	s.smtp.mu.Unlock()
+
+	s.Logger.Log(fmt.Sprintf("SMTP listener started on %s\n", ln.Addr()))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !s.draining.Load() {
+					s.Logger.Log(fmt.Sprintf("SMTP listener stopped: %s\n", err), logger.ERROR)
+				}
+				return
+			}
+			go s.handleSMTP(conn)
+		}
+	}()
+	return nil
+}
+
+// Close the connections to the SMTP listener. The listener itself is closed
+// along with the other listeners.
+func (s *TcpServer) stopSMTP() {
+	s.smtp.mu.Lock()
+	defer s.smtp.mu.Unlock()
+	for conn := range s.smtp.conns {
+		conn.Close()
+	}
+}
+
+// Handle a connection to the SMTP listener, reading commands until the sender
+// quits or the connection is closed.
+func (s *TcpServer) handleSMTP(conn net.Conn) {
+	s.smtp.mu.Lock()
+	if s.draining.Load() {
+		s.smtp.mu.Unlock()
+		fmt.Fprintf(conn, "421 4.3.2 Server shutting down\r\n")
+		conn.Close()
+		return
+	}
+	if s.smtp.conns == nil {
+		s.smtp.conns = make(map[net.Conn]struct{})
+	}
+	s.smtp.conns[conn] = struct{}{}
+	s.smtp.mu.Unlock()
+
+	defer func() {
+		s.smtp.mu.Lock()
+		delete(s.smtp.conns, conn)
+		s.smtp.mu.Unlock()
+		conn.Close()
+	}()
+
+	session := &smtpSession{conn: conn, reader: bufio.NewReader(conn)}
+	hostname := smtpHostname()
+	session.reply(220, fmt.Sprintf("%s TCPNotificationManager ESMTP ready", hostname))
+
+	for {
+		conn.SetDeadline(time.Now().Add(smtpTimeout))
+		line, err := session.readLine()
+		if errors.Is(err, bufio.ErrBufferFull) {
+			session.reply(500, "5.5.2 Line too long")
+			return
+		} else if err != nil {
+			return
+		}
+
+		if s.draining.Load() {
+			session.reply(421, "4.3.2 Server shutting down")
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			session.reset()
+			session.helo = true
+			session.reply(250, hostname)
+		case "EHLO":
+			session.reset()
+			session.helo = true
+			session.reply(250, hostname, fmt.Sprintf("SIZE %d", smtpMaxMessageSize), "8BITMIME")
+		case "MAIL":
+			s.smtpMail(session, arg)
+		case "RCPT":
+			s.smtpRcpt(session, arg)
+		case "DATA":
+			if !s.smtpData(session) {
+				return
+			}
+		case "RSET":
+			session.reset()
+			session.reply(250, "2.0.0 OK")
+		case "NOOP":
+			session.reply(250, "2.0.0 OK")
+		case "VRFY":
+			session.reply(252, "2.5.0 Cannot verify the user")
+		case "QUIT":
+			session.reply(221, "2.0.0 Bye")
+			return
+		default:
+			session.reply(502, "5.5.1 Command not implemented")
+		}
+	}
+}
+
+// Handle the MAIL command, which starts a new email.
+func (s *TcpServer) smtpMail(session *smtpSession, arg string) {
+	if !session.helo {
+		session.reply(503, "5.5.1 Send HELO or EHLO first")
+		return
+	}
+
+	from, ok := smtpPath(arg, "FROM:")
+	if !ok {
+		session.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	session.reset()
+	session.mail = true
+	session.from = from
+	session.reply(250, "2.1.0 OK")
+}
+
+// Handle the RCPT command. Only the mailboxes in the server options are
+// accepted, and their publisher must have the publish permission.
+func (s *TcpServer) smtpRcpt(session *smtpSession, arg string) {
+	if !session.mail {
+		session.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+
+	rcpt, ok := smtpPath(arg, "TO:")
+	if !ok || rcpt == "" {
+		session.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+
+	address, mailbox, found := s.findMailbox(rcpt)
+	if !found {
+		session.reply(550, "5.1.1 No such mailbox")
+		return
+	}
+	if !utils.Contains(s.Policy.Permissions(mailbox.publisher(address)), policy.Publish) {
+		session.reply(550, "5.7.1 Mailbox is not allowed to publish")
+		return
+	}
+	if len(session.rcpts) >= smtpMaxRecipients {
+		session.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	if !utils.Contains(session.rcpts, address) {
+		session.rcpts = append(session.rcpts, address)
+	}
+	session.reply(250, "2.1.5 OK")
+}
+
+// Handle the DATA command, reading the email and publishing a message for each
+// of its recipients. Returns false when the connection should be closed.
+func (s *TcpServer) smtpData(session *smtpSession) bool {
+	if len(session.rcpts) == 0 {
+		session.reply(503, "5.5.1 Send RCPT first")
+		return true
+	}
+	session.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	// The dot reader removes the dot stuffing and stops at the line with
+	// a single dot. Anything past the max size is read and discarded, so
+	// the sender is still in sync with the commands.
+	dot := textproto.NewReader(session.reader).DotReader()
+	data, err := io.ReadAll(io.LimitReader(dot, smtpMaxMessageSize+1))
+	if err != nil {
+		return false
+	}
+	if len(data) > smtpMaxMessageSize {
+		if _, err := io.Copy(io.Discard, dot); err != nil {
+			return false
+		}
+		session.reset()
+		session.reply(552, "5.3.4 Message too big")
+		return true
+	}
+
+	defer session.reset()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		session.reply(554, fmt.Sprintf("5.6.0 Malformed message: %s", err))
+		return true
+	}
+
+	content, err := smtpContent(msg)
+	if err != nil {
+		session.reply(554, fmt.Sprintf("5.6.0 Malformed message: %s", err))
+		return true
+	}
+
+	// The email is published for every recipient even if an earlier one
+	// failed. The sender retries the whole email when it is not accepted,
+	// which would publish it again for the recipients which succeeded, so
+	// it is only rejected when it could not be published for any of them.
+	published := 0
+	for _, address := range session.rcpts {
+		mailbox := s.Opts.SMTPMailboxes[address]
+
+		message := content
+		message.Topic = mailbox.Topic
+		if message.Priority == "" {
+			message.Priority = mailbox.Priority
+		}
+
+		delivered, err := s.Publish(mailbox.publisher(address), message)
+		if err != nil {
+			s.Logger.Log(fmt.Sprintf("Error publishing email to '%s': %s\n", address, err), logger.ERROR)
+			continue
+		}
+		published++
+		s.Logger.Log(fmt.Sprintf("Email from '%s' to '%s' published to %d client(s)\n", session.from, address, delivered), logger.DEBUG)
+	}
+
+	if published == 0 {
+		session.reply(451, "4.3.0 Message could not be broadcast")
+		return true
+	}
+	session.reply(250, "2.0.0 OK: message published")
+	return true
+}
+
+// Find the mailbox for an address, the address is compared without case.
+// The address as it is written in the server options is returned.
+func (s *TcpServer) findMailbox(address string) (string, SMTPMailbox, bool) {
+	for configured, mailbox := range s.Opts.SMTPMailboxes {
+		if strings.EqualFold(configured, address) {
+			return configured, mailbox, true
+		}
+	}
+	return "", SMTPMailbox{}, false
+}
+
+// Get the name of the publisher for the mailbox at the address.
+func (m SMTPMailbox) publisher(address string) string {
+	if m.Publisher != "" {
+		return m.Publisher
+	}
+	return address
+}
+
+// Build the message for an email. The subject is the title, and the text of the
+// body is the message. When the email only has a subject, the subject is also
+// used as the message.
+func smtpContent(msg *mail.Message) (events.SendMessageContent, error) {
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	subject = strings.TrimSpace(subject)
+
+	text, err := mailText(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return events.SendMessageContent{}, err
+	}
+	text = truncateText(strings.TrimSpace(text), smtpMaxTextSize)
+
+	content := events.SendMessageContent{Message: text, Title: subject, Priority: mailPriority(msg.Header)}
+	if content.Message == "" {
+		content.Message = subject
+	}
+	if content.Message == "" {
+		content.Message = "(empty email)"
+	}
+	if content.Title == "" {
+		if from, err := msg.Header.AddressList("From"); err == nil && len(from) > 0 {
+			content.Title = from[0].Address
+		}
+	}
+	return content, nil
+}
+
+// Get the text of the body of an email or a part of a multipart email. The
+// text version of a multipart body is preferred, the HTML version is used with
+// its tags removed when there is no text version. Attachments are ignored.
+func mailText(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(body, params["boundary"])
+		var htmlText string
+		for {
+			part, err := reader.NextRawPart()
+			if errors.Is(err, io.EOF) {
+				return htmlText, nil
+			} else if err != nil {
+				return "", err
+			}
+
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+
+			text, err := mailText(part.Header, part)
+			if err != nil {
+				return "", err
+			}
+
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if partType == "text/html" {
+				if htmlText == "" {
+					htmlText = text
+				}
+				continue
+			}
+			if text != "" {
+				return text, nil
+			}
+		}
+
+	case mediaType == "text/html":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return "", err
+		}
+		return html.UnescapeString(htmlTag.ReplaceAllString(string(data), "")), nil
+
+	case mediaType == "text/plain":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return "", err
+		}
+		return strings.ReplaceAll(string(data), "\r\n", "\n"), nil
+
+	default:
+		return "", nil
+	}
+}
+
+// Get the priority of an email from its X-Priority or Importance header. An
+// empty priority is returned when the email does not have either header.
+func mailPriority(header mail.Header) string {
+	if priority := strings.TrimSpace(header.Get("X-Priority")); priority != "" {
+		switch priority[0] {
+		case '1':
+			return events.PriorityUrgent
+		case '2':
+			return events.PriorityHigh
+		case '4', '5':
+			return events.PriorityLow
+		}
+		return ""
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Importance"))) {
+	case "high":
+		return events.PriorityHigh
+	case "low":
+		return events.PriorityLow
+	}
+	return ""
+}
+
+// Truncate the text to at most size bytes, without splitting a character.
+func truncateText(text string, size int) string {
+	if len(text) <= size {
+		return text
+	}
+	text = text[:size]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text + "…"
+}
+
+// Get the address from the argument of the MAIL or RCPT command, such as
+// 'FROM:<alice@example.com> SIZE=100'. The parameters after the address are
+// ignored. An empty address is valid for MAIL, it is used for bounces.
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+
+	if strings.HasPrefix(path, "<") {
+		end := strings.Index(path, ">")
+		if end < 0 {
+			return "", false
+		}
+		return path[1:end], true
+	}
+
+	address, _, _ := strings.Cut(path, " ")
+	return address, address != ""
+}
+
+// Get the hostname the listener introduces itself with.
+func smtpHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+// Read a command line from the sender, without the line ending. Lines longer
+// than the buffer of the reader are rejected.
+func (session *smtpSession) readLine() (string, error) {
+	line, err := session.reader.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// Write a reply to the sender. When there is more than one line, every line
+// but the last is marked as a continuation.
+func (session *smtpSession) reply(code int, lines ...string) {
+	var b strings.Builder
+	for i, line := range lines {
+		separator := " "
+		if i < len(lines)-1 {
+			separator = "-"
+		}
+		fmt.Fprintf(&b, "%d%s%s\r\n", code, separator, line)
+	}
+	io.WriteString(session.conn, b.String())
+}
+
+// Forget the email in progress.
+func (session *smtpSession) reset() {
+	session.mail = false
+	session.from = ""
+	session.rcpts = nil
+}
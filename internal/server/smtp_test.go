@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/policy"
+	"github.com/Azpect3120/TCPNotificationManager/pkg/tnm"
+)
+
+// Start a server with the mailboxes and an SMTP listener on a random port, and
+// connect a client which receives the published messages. Returns the server,
+// the address of the SMTP listener and the messages received by the client.
+// The server is shut down when the test finishes.
+func startSMTPServer(t *testing.T, mailboxes map[string]SMTPMailbox, p *policy.Policy) (*TcpServer, string, <-chan tnm.Event) {
+	t.Helper()
+
+	s := NewTCPServer(WithSMTP("127.0.0.1:0", mailboxes))
+	s.Logger = logger.NewLogger(logger.WithOutput(io.Discard))
+	if p != nil {
+		s.Policy = p
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	if err := s.startSMTP(); err != nil {
+		t.Fatal(err)
+	}
+	s.smtp.mu.Lock()
+	addr := s.smtp.ln.Addr().String()
+	s.smtp.mu.Unlock()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ctx, ln)
+
+	c, err := tnm.Dial(ctx, tnm.Options{Addr: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return s, addr, c.Subscribe(ctx)
+}
+
+// Wait for the next message received by the client.
+func nextMessage(t *testing.T, sub <-chan tnm.Event) tnm.Message {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-sub:
+			if msg, ok := event.(tnm.Message); ok {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+}
+
+func TestSMTPBodies(t *testing.T) {
+	_, addr, sub := startSMTPServer(t, map[string]SMTPMailbox{
+		"backups@tnm.local": {Publisher: "cron", Topic: "backups"},
+	}, nil)
+
+	tests := []struct {
+		name  string
+		email string
+		want  tnm.Message
+	}{
+		{
+			name:  "plain",
+			email: "Subject: Backups\r\nX-Priority: 1\r\n\r\nNightly backup finished\r\n",
+			want:  tnm.Message{Sender: "cron", Title: "Backups", Text: "Nightly backup finished", Topic: "backups", Priority: "urgent"},
+		},
+		{
+			name: "multipart",
+			email: "Subject: Power\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=XX\r\n\r\n" +
+				"--XX\r\nContent-Type: text/html\r\n\r\n<p>On <b>battery</b></p>\r\n" +
+				"--XX\r\nContent-Type: text/plain\r\n\r\nOn battery\r\n--XX--\r\n",
+			want: tnm.Message{Sender: "cron", Title: "Power", Text: "On battery", Topic: "backups"},
+		},
+		{
+			name:  "html",
+			email: "Subject: Report\r\nContent-Type: text/html\r\n\r\n<h1>Disk &amp; memory</h1>\r\n",
+			want:  tnm.Message{Sender: "cron", Title: "Report", Text: "Disk & memory", Topic: "backups"},
+		},
+		{
+			name:  "quoted-printable",
+			email: "Subject: Runtime\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nRuntime =E2=80=93 10=\r\n minutes\r\n",
+			want:  tnm.Message{Sender: "cron", Title: "Runtime", Text: "Runtime – 10 minutes", Topic: "backups"},
+		},
+		{
+			name:  "base64",
+			email: "Subject: Encoded\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\nRW5jb2RlZCBib2R5\r\n",
+			want:  tnm.Message{Sender: "cron", Title: "Encoded", Text: "Encoded body", Topic: "backups"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := smtp.SendMail(addr, nil, "cron@localhost", []string{"backups@tnm.local"}, []byte(tt.email)); err != nil {
+				t.Fatal(err)
+			}
+
+			got := nextMessage(t, sub)
+			got.Timestamp = time.Time{}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSMTPMultipleRecipients(t *testing.T) {
+	_, addr, sub := startSMTPServer(t, map[string]SMTPMailbox{
+		"backups@tnm.local": {Topic: "backups"},
+		"ups@tnm.local":     {Topic: "ups"},
+	}, nil)
+
+	if err := smtp.SendMail(addr, nil, "", []string{"backups@tnm.local", "UPS@tnm.local"}, []byte("Subject: Both\r\n\r\nSent to both\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	topics := map[string]bool{}
+	for range 2 {
+		topics[nextMessage(t, sub).Topic] = true
+	}
+	if !topics["backups"] || !topics["ups"] {
+		t.Errorf("got topics %v, want backups and ups", topics)
+	}
+}
+
+func TestSMTPRecipientDeniedByPolicy(t *testing.T) {
+	p := &policy.Policy{
+		Roles:   map[string][]policy.Permission{"all": {policy.Publish, policy.Subscribe}, "none": {}},
+		Devices: map[string][]string{"blocked": {"none"}},
+		Default: []string{"all"},
+	}
+	_, addr, sub := startSMTPServer(t, map[string]SMTPMailbox{
+		"backups@tnm.local": {Publisher: "cron", Topic: "backups"},
+		"blocked@tnm.local": {Publisher: "blocked", Topic: "blocked"},
+	}, p)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("cron@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("backups@tnm.local"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("blocked@tnm.local")
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Fatalf("got %v, want a 550 error for the denied mailbox", err)
+	}
+
+	// The email is still accepted for the mailbox which is allowed to
+	// publish, and is only published once.
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "Subject: Backups\r\n\r\nNightly backup finished\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("got %v, want a 250 reply", err)
+	}
+
+	if msg := nextMessage(t, sub); msg.Sender != "cron" || msg.Topic != "backups" {
+		t.Errorf("got message %+v, want one from cron", msg)
+	}
+	select {
+	case event := <-sub:
+		t.Errorf("got another event %+v, want one message", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSMTPShutdown(t *testing.T) {
+	s, addr, _ := startSMTPServer(t, map[string]SMTPMailbox{"backups@tnm.local": {}}, nil)
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener is closed along with the other listeners, and the open
+	// connection is closed by the server.
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("SMTP listener is still accepting connections")
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Error("SMTP connection was not closed")
+	}
+}
+
+func TestSMTPUnknownRecipient(t *testing.T) {
+	_, addr, _ := startSMTPServer(t, map[string]SMTPMailbox{"backups@tnm.local": {}}, nil)
+
+	err := smtp.SendMail(addr, nil, "cron@localhost", []string{"root@elsewhere"}, []byte("Subject: x\r\n\r\nx\r\n"))
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Fatalf("got %v, want a 550 error", err)
+	}
+}
+
+func TestSMTPMessageTooBig(t *testing.T) {
+	_, addr, _ := startSMTPServer(t, map[string]SMTPMailbox{"backups@tnm.local": {}}, nil)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("cron@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("backups@tnm.local"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The line endings are counted as a single byte once the email has
+	// been read, so extra lines are sent to go over the limit.
+	line := strings.Repeat("x", 998) + "\r\n"
+	io.WriteString(w, "Subject: Big\r\n\r\n")
+	for range smtpMaxMessageSize/len(line) + 100 {
+		io.WriteString(w, line)
+	}
+
+	err = w.Close()
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 552 {
+		t.Fatalf("got %v, want a 552 error", err)
+	}
+
+	// The rest of the email is discarded, so the connection can still be
+	// used for the next email.
+	if err := c.Noop(); err != nil {
+		t.Errorf("connection was not usable after the 552: %v", err)
+	}
+}
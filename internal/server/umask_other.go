@@ -0,0 +1,11 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// Run fn, the umask is only supported on Unix platforms, so the permissions
+// of the files created by fn are not restricted.
+func withUmask(mode os.FileMode, fn func() error) error {
+	return fn()
+}
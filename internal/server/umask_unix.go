@@ -0,0 +1,23 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// The umask is shared by the whole process, so changes to it are serialized.
+var umaskMu sync.Mutex
+
+// Run fn with a umask which only allows the permissions in the mode, so files
+// created by fn never have wider permissions than the mode, even briefly.
+func withUmask(mode os.FileMode, fn func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	old := syscall.Umask(int(^mode.Perm() & os.ModePerm))
+	defer syscall.Umask(old)
+	return fn()
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Processes on the same host as the server can connect over a Unix socket,
+// without TLS or a client certificate. Access to the socket is controlled by
+// its file permissions, and each connection is identified by the user which
+// owns the connecting process, which the kernel reports for the socket.
+//
+// The identity of the user is used as the device name, so the policy applies
+// to local publishers the same way it applies to devices.
+
+// errPeerCredUnsupported is returned when the identity of the process on the
+// other side of a Unix socket cannot be found on this platform.
+var errPeerCredUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// Listen on the Unix socket in the server options. A socket left behind by a
+// server which did not shut down cleanly is removed, but a socket which is
+// still accepting connections is left alone and an error is returned, so a
+// second server cannot take over the socket of a running one. Any other file
+// at the path is also left alone.
+func (s *TcpServer) listenUnix() (net.Listener, error) {
+	path := s.Opts.UnixSocket
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("cannot listen on %s: file exists and is not a socket", path)
+		}
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// The socket is created with the permissions in the server options,
+	// instead of changing them after it is created, so it is never
+	// reachable with the wider permissions of the umask. The socket is
+	// removed when the listener is closed.
+	var ln net.Listener
+	err := withUmask(s.Opts.UnixSocketMode, func() error {
+		var err error
+		ln, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Remove the socket at the path if nothing is listening on it. The socket is
+// only removed when the connection is refused, any other error is returned
+// since the socket may still be in use.
+func removeStaleSocket(path string) error {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("cannot listen on %s: address already in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("cannot listen on %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// Identify the user which owns the process on the other side of a Unix socket.
+// Users listed in the server options are given the identity they are mapped
+// to, any other user is identified as 'unix-<username>'.
+func (s *TcpServer) identifyUnix(conn *net.UnixConn) (string, error) {
+	uid, err := peerUID(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read peer credentials: %w", err)
+	}
+
+	if identity, ok := s.Opts.UnixUsers[uid]; ok {
+		return identity, nil
+	}
+
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return "unix-" + u.Username, nil
+	}
+	return "unix-" + id, nil
+}
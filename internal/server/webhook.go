@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+	"github.com/Azpect3120/TCPNotificationManager/internal/utils"
+)
+
+// Recipients which are not desktops, such as chat rooms and ticketing systems,
+// can be sent the published messages as webhooks. Each webhook receives an HTTP
+// POST for every message which matches its filters, the body is the JSON of
+// the broadcast_message event the clients receive.
+//
+// When the webhook has a secret, the request is signed so the receiver can
+// check it was sent by the server. The signature is the hex encoded HMAC-SHA256
+// of the timestamp header, a period, and the body, using the secret as the key:
+//
+//	X-TNM-Timestamp: 1760000000
+//	X-TNM-Signature: sha256=<hex(hmac_sha256(secret, "1760000000." + body))>
+//
+// Failed deliveries are retried with an exponential backoff. Deliveries which
+// still fail, or which are rejected by the receiver, are written to the dead
+// letter log along with the body, so they can be inspected or replayed.
+
+// Headers set on every webhook request.
+const (
+	WebhookDeliveryHeader  = "X-TNM-Delivery"
+	WebhookTimestampHeader = "X-TNM-Timestamp"
+	WebhookSignatureHeader = "X-TNM-Signature"
+)
+
+// Number of deliveries which can be waiting for each webhook. When the queue is
+// full, the delivery is written to the dead letter log instead.
+const webhookQueueSize = 256
+
+// Delay before the first retry of a failed delivery, which doubles after each
+// failed attempt up to the max.
+const (
+	webhookBaseBackoff = time.Second
+	webhookMaxBackoff  = time.Minute
+)
+
+// Webhook is a URL which receives the messages published to the server. The
+// filters are optional, a webhook without filters receives every message.
+type Webhook struct {
+	// URL the messages are posted to.
+	URL string `json:"url"`
+
+	// Key used to sign the requests, the requests are not signed when it
+	// is empty.
+	Secret string `json:"secret"`
+
+	// Only deliver messages with one of the topics.
+	Topics []string `json:"topics"`
+
+	// Only deliver messages with at least this priority. Messages without
+	// a priority have the normal priority.
+	MinPriority string `json:"min_priority"`
+}
+
+// Check the webhook is valid, the URL must be absolute and use HTTP or HTTPS.
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL '%s': %w", w.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL '%s': must be an absolute http or https URL", w.URL)
+	}
+	if !events.IsValidPriority(w.MinPriority) {
+		return fmt.Errorf("invalid min priority '%s' for webhook '%s'", w.MinPriority, w.URL)
+	}
+	return nil
+}
+
+// Check if the message matches the filters of the webhook.
+func (w Webhook) matches(message events.BroadcastMessageContent) bool {
+	if len(w.Topics) > 0 && !slices.Contains(w.Topics, message.Topic) {
+		return false
+	}
+	return w.MinPriority == "" || priorityRank(message.Priority) >= priorityRank(w.MinPriority)
+}
+
+// Get the position of the priority from lowest to highest, an empty priority
+// is the normal priority.
+func priorityRank(priority string) int {
+	if priority == "" {
+		priority = events.PriorityNormal
+	}
+	return slices.Index(events.Priorities(), priority)
+}
+
+// A message waiting to be delivered to a webhook.
+type webhookDelivery struct {
+	id   string
+	body []byte
+}
+
+// Entry written to the dead letter log for a delivery which failed.
+type deadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Delivery string          `json:"delivery"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Event    json.RawMessage `json:"event"`
+}
+
+// The state of the webhook workers. There is a worker for each webhook, so a
+// slow receiver does not hold up the others.
+type webhookDispatcher struct {
+	start sync.Once
+
+	// Queue of each webhook, in the same order as the server options. Once
+	// closed is set, no more deliveries are added.
+	mu     sync.Mutex
+	queues []chan webhookDelivery
+	closed bool
+
+	// Cancelled when the server gives up waiting on the deliveries, the
+	// remaining deliveries are written to the dead letter log.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	client *http.Client
+	wg     sync.WaitGroup
+
+	// Serializes the writes to the dead letter log.
+	deadMu sync.Mutex
+}
+
+// Start a worker for each webhook in the server options. The workers are not
+// started once the server has shut down.
+func (s *TcpServer) startWebhooks() {
+	d := &s.webhooks
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.client = &http.Client{Timeout: s.Opts.WebhookTimeout}
+
+	for _, hook := range s.Opts.Webhooks {
+		queue := make(chan webhookDelivery, webhookQueueSize)
+		d.queues = append(d.queues, queue)
+
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for delivery := range queue {
+				s.deliverWebhook(hook, delivery)
+			}
+		}()
+	}
+}
+
+// Queue the message for every webhook it matches. The workers are started the
+// first time a message is published, the message is dropped once the server
+// has shut down.
+func (s *TcpServer) dispatchWebhooks(event events.BroadcastMessageEvent) {
+	if len(s.Opts.Webhooks) == 0 {
+		return
+	}
+	s.webhooks.start.Do(s.startWebhooks)
+
+	type overflowed struct {
+		hook     Webhook
+		delivery webhookDelivery
+	}
+
+	var body []byte
+	var overflow []overflowed
+	d := &s.webhooks
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+
+	for i, hook := range s.Opts.Webhooks {
+		if !hook.matches(event.Content) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				d.mu.Unlock()
+				s.Logger.Log(fmt.Sprintf("Error encoding webhook body: %s\n", err), logger.ERROR)
+				return
+			}
+		}
+
+		delivery := webhookDelivery{id: utils.GenerateRequestID(), body: body}
+		select {
+		case d.queues[i] <- delivery:
+		default:
+			overflow = append(overflow, overflowed{hook, delivery})
+		}
+	}
+	d.mu.Unlock()
+
+	// The deliveries which did not fit in their queue are written to the
+	// dead letter log once the lock is released, so publishing is not held
+	// up by the disk when the webhooks are already falling behind.
+	for _, o := range overflow {
+		s.deadLetter(o.hook, o.delivery, 0, fmt.Errorf("queue is full"))
+	}
+}
+
+// Deliver a message to a webhook, retrying with a backoff until it succeeds,
+// the receiver rejects it, or the retries run out.
+func (s *TcpServer) deliverWebhook(hook Webhook, delivery webhookDelivery) {
+	d := &s.webhooks
+	backoff := webhookBaseBackoff
+
+	for attempt := 1; ; attempt++ {
+		retryAfter, retry, err := s.postWebhook(d.ctx, hook, delivery)
+		if err == nil {
+			s.Metrics.WebhooksDelivered.Add(1)
+			s.Logger.Log(fmt.Sprintf("Webhook delivered to %s (%s)\n", hook.URL, delivery.id), logger.DEBUG)
+			return
+		}
+
+		if !retry || attempt > s.Opts.WebhookRetries || d.ctx.Err() != nil {
+			s.deadLetter(hook, delivery, attempt, err)
+			return
+		}
+
+		// The receiver can ask for a longer wait, but never longer than
+		// the max backoff.
+		wait := max(backoff, min(retryAfter, webhookMaxBackoff))
+		s.Logger.Log(fmt.Sprintf("Webhook delivery to %s failed, retrying in %s: %s\n", hook.URL, wait, err), logger.WARN)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.ctx.Done():
+			timer.Stop()
+			s.deadLetter(hook, delivery, attempt, err)
+			return
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// Send a single request to the webhook. When the request fails, the error is
+// returned along with whether it should be retried, and how long the receiver
+// asked to wait before retrying.
+func (s *TcpServer) postWebhook(ctx context.Context, hook Webhook, delivery webhookDelivery) (time.Duration, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TCPNotificationManager")
+	req.Header.Set(WebhookDeliveryHeader, delivery.id)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+signWebhook(hook.Secret, timestamp, delivery.body))
+	}
+
+	res, err := s.webhooks.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return 0, false, nil
+	}
+
+	err = fmt.Errorf("receiver responded with %s", res.Status)
+	var retryAfter time.Duration
+	if seconds, parseErr := strconv.Atoi(res.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	// Other client errors mean the receiver will never accept the request,
+	// so it is not retried.
+	switch {
+	case res.StatusCode == http.StatusRequestTimeout, res.StatusCode == http.StatusTooManyRequests:
+		return retryAfter, true, err
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		return 0, false, err
+	default:
+		return retryAfter, true, err
+	}
+}
+
+// Sign the body of a webhook request with the secret of the webhook.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record a delivery which could not be made. The failure is always logged, and
+// written to the dead letter log when one is provided in the server options.
+func (s *TcpServer) deadLetter(hook Webhook, delivery webhookDelivery, attempts int, cause error) {
+	s.Metrics.WebhooksFailed.Add(1)
+	s.Logger.Log(fmt.Sprintf("Webhook delivery to %s (%s) failed after %d attempt(s): %s\n", hook.URL, delivery.id, attempts, cause), logger.ERROR)
+
+	if s.Opts.WebhookDeadLetter == "" {
+		return
+	}
+
+	line, err := json.Marshal(deadLetter{
+		Time:     time.Now().UTC(),
+		URL:      hook.URL,
+		Delivery: delivery.id,
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Event:    delivery.body,
+	})
+	if err != nil {
+		s.Logger.Log(fmt.Sprintf("Error encoding dead letter: %s\n", err), logger.ERROR)
+		return
+	}
+
+	d := &s.webhooks
+	d.deadMu.Lock()
+	defer d.deadMu.Unlock()
+
+	file, err := os.OpenFile(s.Opts.WebhookDeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		s.Logger.Log(fmt.Sprintf("Error opening dead letter log: %s\n", err), logger.ERROR)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		s.Logger.Log(fmt.Sprintf("Error writing dead letter log: %s\n", err), logger.ERROR)
+	}
+}
+
+// Stop the webhook workers once the queued deliveries have been made, or the
+// context expires. Once the context expires, the deliveries which have not
+// been made are written to the dead letter log.
+func (s *TcpServer) stopWebhooks(ctx context.Context) error {
+	d := &s.webhooks
+	d.mu.Lock()
+	if d.closed || d.queues == nil {
+		d.closed = true
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+)
+
+// Create a server with the webhook and a dead letter log in a temporary
+// directory. Returns the server and the path of the dead letter log.
+func newWebhookServer(t *testing.T, hook Webhook, retries int) (*TcpServer, string) {
+	t.Helper()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	s := NewTCPServer(WithWebhooks(hook), WithWebhookRetries(retries, 5*time.Second), WithWebhookDeadLetter(deadLetter))
+	s.Logger = logger.NewLogger(logger.WithOutput(io.Discard))
+	if len(s.Errors) > 0 {
+		t.Fatal(s.Errors)
+	}
+	return s, deadLetter
+}
+
+// Publish a message, then wait for the webhook workers to finish delivering it.
+func publishAndWait(t *testing.T, s *TcpServer, message events.SendMessageContent) {
+	t.Helper()
+
+	if _, err := s.Publish("tester", message); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.stopWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read the entries written to the dead letter log, there are none when the log
+// does not exist.
+func readDeadLetters(t *testing.T, path string) []deadLetter {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWebhookSignature(t *testing.T) {
+	const secret = "s3cret"
+
+	var mu sync.Mutex
+	var header http.Header
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	s, deadLetter := newWebhookServer(t, Webhook{URL: receiver.URL, Secret: secret}, 0)
+	publishAndWait(t, s, events.SendMessageContent{Message: "Backup finished", Title: "Backups"})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if header == nil {
+		t.Fatal("webhook was not delivered")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header.Get(WebhookTimestampHeader) + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := header.Get(WebhookSignatureHeader); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+	if header.Get(WebhookDeliveryHeader) == "" {
+		t.Error("delivery header is not set")
+	}
+
+	var event events.BroadcastMessageEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Content.Message != "Backup finished" || event.Content.Title != "Backups" || event.Content.Sender != "tester" {
+		t.Errorf("got content %+v", event.Content)
+	}
+
+	if entries := readDeadLetters(t, deadLetter); len(entries) != 0 {
+		t.Errorf("got %d dead letters, want none", len(entries))
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	const retries = 2
+	s, deadLetter := newWebhookServer(t, Webhook{URL: receiver.URL}, retries)
+	publishAndWait(t, s, events.SendMessageContent{Message: "Backup failed"})
+
+	if got := attempts.Load(); got != retries+1 {
+		t.Errorf("got %d attempts, want %d", got, retries+1)
+	}
+
+	entries := readDeadLetters(t, deadLetter)
+	if len(entries) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(entries))
+	}
+	if entries[0].Attempts != retries+1 || entries[0].URL != receiver.URL {
+		t.Errorf("got dead letter %+v", entries[0])
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	s, deadLetter := newWebhookServer(t, Webhook{URL: receiver.URL}, 2)
+	publishAndWait(t, s, events.SendMessageContent{Message: "Backup failed"})
+
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+
+	entries := readDeadLetters(t, deadLetter)
+	if len(entries) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(entries))
+	}
+
+	var event events.BroadcastMessageEvent
+	if err := json.Unmarshal(entries[0].Event, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Content.Message != "Backup failed" {
+		t.Errorf("got dead letter event %+v", event.Content)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    Webhook
+		message events.BroadcastMessageContent
+		want    bool
+	}{
+		{"no filters", Webhook{}, events.BroadcastMessageContent{}, true},
+		{"topic matches", Webhook{Topics: []string{"backups", "ups"}}, events.BroadcastMessageContent{Topic: "ups"}, true},
+		{"topic does not match", Webhook{Topics: []string{"backups"}}, events.BroadcastMessageContent{Topic: "ups"}, false},
+		{"topic missing", Webhook{Topics: []string{"backups"}}, events.BroadcastMessageContent{}, false},
+		{"priority above min", Webhook{MinPriority: events.PriorityHigh}, events.BroadcastMessageContent{Priority: events.PriorityUrgent}, true},
+		{"priority equals min", Webhook{MinPriority: events.PriorityHigh}, events.BroadcastMessageContent{Priority: events.PriorityHigh}, true},
+		{"priority below min", Webhook{MinPriority: events.PriorityHigh}, events.BroadcastMessageContent{Priority: events.PriorityNormal}, false},
+		{"empty priority is normal", Webhook{MinPriority: events.PriorityNormal}, events.BroadcastMessageContent{}, true},
+		{"empty priority below high", Webhook{MinPriority: events.PriorityHigh}, events.BroadcastMessageContent{}, false},
+		{"low passes without min", Webhook{}, events.BroadcastMessageContent{Priority: events.PriorityLow}, true},
+		{"both filters", Webhook{Topics: []string{"backups"}, MinPriority: events.PriorityHigh}, events.BroadcastMessageContent{Topic: "backups", Priority: events.PriorityLow}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hook.matches(tt.message); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookFiltersDeliveries(t *testing.T) {
+	var mu sync.Mutex
+	var topics []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event events.BroadcastMessageEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		topics = append(topics, event.Content.Topic)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	s, _ := newWebhookServer(t, Webhook{URL: receiver.URL, Topics: []string{"backups"}, MinPriority: events.PriorityHigh}, 0)
+	for _, message := range []events.SendMessageContent{
+		{Message: "ignored topic", Topic: "ups", Priority: events.PriorityUrgent},
+		{Message: "ignored priority", Topic: "backups", Priority: events.PriorityNormal},
+		{Message: "delivered", Topic: "backups", Priority: events.PriorityHigh},
+	} {
+		if _, err := s.Publish("tester", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publishAndWait(t, s, events.SendMessageContent{Message: "delivered", Topic: "backups", Priority: events.PriorityUrgent})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(topics) != 2 {
+		t.Errorf("got %d deliveries, want 2", len(topics))
+	}
+}
@@ -18,6 +18,12 @@ func GenerateClientID() string {
 	return fmt.Sprintf("client-%s", uuid.NewString())
 }
 
+// Create a random ID for a request. This is used by the clients to
+// correlate the response from the server with the request.
+func GenerateRequestID() string {
+	return fmt.Sprintf("request-%s", uuid.NewString())
+}
+
 // Check if an item exists in a slice. This function is generic
 // and can be used with any type that is comparable.
 func Contains[T comparable](slice []T, item T) bool {
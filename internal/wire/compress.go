@@ -0,0 +1,102 @@
+package wire
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// The default size in bytes a payload must reach before it is compressed.
+// Small payloads do not compress well and are not worth the CPU time.
+const DefaultCompressionThreshold = 512
+
+// Stats tracks how well the payloads sent and received over a connection
+// compress. A single Stats can be shared by multiple connections to track
+// the totals for a server, the counters are safe to use concurrently.
+type Stats struct {
+	// Number of frames which were compressed, in either direction.
+	CompressedFrames atomic.Int64
+
+	// Number of frames which were below the compression threshold, or did
+	// not get smaller when compressed, and were sent uncompressed.
+	UncompressedFrames atomic.Int64
+
+	// Size of the compressed payloads before and after compression.
+	BytesBeforeCompression atomic.Int64
+	BytesAfterCompression  atomic.Int64
+}
+
+// CompressionRatio returns the size of the compressed payloads divided by
+// their original size. A lower ratio is better, zero is returned when no
+// payloads have been compressed.
+func (s *Stats) CompressionRatio() float64 {
+	before := s.BytesBeforeCompression.Load()
+	if before == 0 {
+		return 0
+	}
+	return float64(s.BytesAfterCompression.Load()) / float64(before)
+}
+
+// Record a compressed payload in the stats.
+func (s *Stats) recordCompressed(before, after int) {
+	if s == nil {
+		return
+	}
+	s.CompressedFrames.Add(1)
+	s.BytesBeforeCompression.Add(int64(before))
+	s.BytesAfterCompression.Add(int64(after))
+}
+
+// Record a payload which was sent uncompressed in the stats.
+func (s *Stats) recordUncompressed() {
+	if s == nil {
+		return
+	}
+	s.UncompressedFrames.Add(1)
+}
+
+// The flate writers are expensive to create, so they are reused.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// Compress the payload using deflate.
+func compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress the payload, returning ErrFrameTooLarge if the decompressed
+// payload is larger than the max size, along with the start of the payload.
+// The limit protects against small frames which decompress into huge payloads.
+func decompress(payload []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress frame: %w", err)
+	}
+	if len(out) > max {
+		// The start of the payload is returned, so the base of the event
+		// can still be peeked.
+		return out[:min(len(out), peekSize)], fmt.Errorf("%w: decompressed payload exceeds %d bytes", ErrFrameTooLarge, max)
+	}
+	return out, nil
+}
@@ -0,0 +1,613 @@
+package wire
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket carries the frames over a WebSocket connection, for clients which
+// are behind proxies that only allow HTTP. The connection is adapted into a
+// stream of frames, so it can be wrapped by a Conn and used exactly like a TCP
+// connection.
+//
+// Frames without flags, which are the JSON events, are sent as text messages
+// containing only the payload, so a browser can send and receive the events
+// without knowing about the frame header. Every other frame is sent as a binary
+// message containing the whole frame, header included.
+//
+// Only the parts of RFC 6455 needed by the server and client are implemented,
+// extensions and subprotocols are not supported.
+
+// The GUID appended to the key of the client to create the accept key, as
+// defined by RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Time allowed for the opening handshake, after which the connection is
+// closed.
+const websocketHandshakeTimeout = 10 * time.Second
+
+// Opcodes of the WebSocket frames.
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xA
+)
+
+// Status codes sent in the close frames.
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+// ErrWebSocketProtocol is returned when the peer breaks the WebSocket protocol.
+// The connection is closed, as the stream cannot be trusted.
+var ErrWebSocketProtocol = errors.New("websocket protocol error")
+
+// WebSocketConn is a WebSocket connection, adapted into a stream of frames. It
+// embeds the underlying connection, so the addresses and deadlines are those
+// of the underlying connection.
+//
+// Each call to Write must contain a whole frame, which is how Conn writes the
+// frames. Reads return the frames in the messages sent by the peer.
+type WebSocketConn struct {
+	net.Conn
+
+	// Largest fragmented message which will be read. Messages which are not
+	// fragmented are streamed, so they are limited by the max frame size of
+	// the Conn reading them instead.
+	MaxMessageSize int
+
+	// The client masks the frames it sends, the server does not.
+	client bool
+
+	r *bufio.Reader
+
+	// Bytes to return before the rest of the current frame, such as the
+	// header created for a text message.
+	pending []byte
+
+	// The WebSocket frame being streamed, and how much of it is left.
+	frame     wsFrame
+	remaining int64
+	maskPos   int
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+	closeSent bool
+}
+
+// Header of a single WebSocket frame.
+type wsFrame struct {
+	fin    bool
+	opcode byte
+	length int64
+	masked bool
+	mask   [4]byte
+}
+
+// NetConn returns the underlying connection.
+func (c *WebSocketConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read the frames sent by the peer. Ping frames are answered here, and a close
+// frame from the peer is returned as io.EOF once the close has been answered.
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	for {
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+
+		if c.remaining > 0 {
+			n, err := c.readPayload(p[:min(int64(len(p)), c.remaining)])
+			c.remaining -= int64(n)
+			return n, err
+		}
+
+		if err := c.nextMessage(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Read the next message sent by the peer. Messages in a single frame are left
+// to be streamed by Read, fragmented messages are read into pending.
+func (c *WebSocketConn) nextMessage() error {
+	frame, err := c.readControlled()
+	if err != nil {
+		return err
+	}
+
+	switch frame.opcode {
+	case wsText, wsBinary:
+	default:
+		return c.fail(wsCloseProtocolError, fmt.Errorf("%w: unexpected opcode %#x", ErrWebSocketProtocol, frame.opcode))
+	}
+
+	if frame.fin {
+		if frame.opcode == wsText {
+			if frame.length > int64(^uint32(0)) {
+				return c.fail(wsCloseTooBig, fmt.Errorf("%w: message of %d bytes is too large", ErrWebSocketProtocol, frame.length))
+			}
+			c.pending = textHeader(int(frame.length))
+		}
+		c.frame, c.remaining, c.maskPos = frame, frame.length, 0
+		return nil
+	}
+
+	// The size of a fragmented message is only known once every fragment
+	// has been read, so the message is read into memory. Only the first
+	// fragment carries the type of the message.
+	opcode := frame.opcode
+	var message []byte
+	for {
+		if int64(len(message))+frame.length > int64(c.MaxMessageSize) {
+			return c.fail(wsCloseTooBig, fmt.Errorf("%w: message exceeds %d bytes", ErrWebSocketProtocol, c.MaxMessageSize))
+		}
+
+		start := len(message)
+		message = append(message, make([]byte, frame.length)...)
+		c.frame, c.remaining, c.maskPos = frame, frame.length, 0
+		if _, err := io.ReadFull(readerFunc(c.readPayload), message[start:]); err != nil {
+			return err
+		}
+		c.remaining = 0
+
+		if frame.fin {
+			break
+		}
+		if frame, err = c.readControlled(); err != nil {
+			return err
+		}
+		if frame.opcode != wsContinuation {
+			return c.fail(wsCloseProtocolError, fmt.Errorf("%w: expected a continuation frame", ErrWebSocketProtocol))
+		}
+	}
+
+	if opcode == wsText {
+		message = append(textHeader(len(message)), message...)
+	}
+	c.pending = message
+	return nil
+}
+
+// Read the next data frame, answering any control frames sent before it.
+func (c *WebSocketConn) readControlled() (wsFrame, error) {
+	for {
+		frame, err := c.readHeader()
+		if err != nil {
+			return wsFrame{}, err
+		}
+		if frame.opcode < wsClose {
+			return frame, nil
+		}
+
+		payload := make([]byte, frame.length)
+		c.frame, c.remaining, c.maskPos = frame, frame.length, 0
+		if _, err := io.ReadFull(readerFunc(c.readPayload), payload); err != nil {
+			return wsFrame{}, err
+		}
+		c.remaining = 0
+
+		switch frame.opcode {
+		case wsPing:
+			if err := c.writeMessage(wsPong, payload); err != nil {
+				return wsFrame{}, err
+			}
+		case wsPong:
+		case wsClose:
+			// Echo the status code of the peer, then report the end of
+			// the stream.
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.sendClose(code)
+			return wsFrame{}, io.EOF
+		default:
+			return wsFrame{}, c.fail(wsCloseProtocolError, fmt.Errorf("%w: unknown opcode %#x", ErrWebSocketProtocol, frame.opcode))
+		}
+	}
+}
+
+// Read the header of the next WebSocket frame.
+func (c *WebSocketConn) readHeader() (wsFrame, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(c.r, b[:2]); err != nil {
+		return wsFrame{}, err
+	}
+
+	frame := wsFrame{
+		fin:    b[0]&0x80 != 0,
+		opcode: b[0] & 0x0f,
+		masked: b[1]&0x80 != 0,
+		length: int64(b[1] & 0x7f),
+	}
+
+	// The reserved bits are only used by extensions, which are not supported.
+	if b[0]&0x70 != 0 {
+		return wsFrame{}, c.fail(wsCloseProtocolError, fmt.Errorf("%w: reserved bits are set", ErrWebSocketProtocol))
+	}
+
+	switch frame.length {
+	case 126:
+		if _, err := io.ReadFull(c.r, b[:2]); err != nil {
+			return wsFrame{}, err
+		}
+		frame.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.r, b[:8]); err != nil {
+			return wsFrame{}, err
+		}
+		length := binary.BigEndian.Uint64(b[:8])
+		if length>>63 != 0 {
+			return wsFrame{}, c.fail(wsCloseProtocolError, fmt.Errorf("%w: invalid frame length", ErrWebSocketProtocol))
+		}
+		frame.length = int64(length)
+	}
+
+	if frame.masked {
+		if _, err := io.ReadFull(c.r, frame.mask[:]); err != nil {
+			return wsFrame{}, err
+		}
+	}
+
+	// Frames sent by a client must be masked, and frames sent by a server
+	// must not be.
+	if frame.masked == c.client {
+		return wsFrame{}, c.fail(wsCloseProtocolError, fmt.Errorf("%w: unexpected masking", ErrWebSocketProtocol))
+	}
+	if frame.opcode >= wsClose && (!frame.fin || frame.length > 125) {
+		return wsFrame{}, c.fail(wsCloseProtocolError, fmt.Errorf("%w: invalid control frame", ErrWebSocketProtocol))
+	}
+	return frame, nil
+}
+
+// Read part of the payload of the current frame, removing the mask.
+func (c *WebSocketConn) readPayload(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.frame.masked {
+		for i := range p[:n] {
+			p[i] ^= c.frame.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Write a frame to the peer. A frame without flags is sent as a text message
+// containing the payload, anything else is sent as a binary message.
+func (c *WebSocketConn) Write(p []byte) (int, error) {
+	opcode, payload := wsBinary, p
+	if len(p) >= HeaderSize && p[4] == 0 && int(binary.BigEndian.Uint32(p[:4])) == len(p)-HeaderSize {
+		opcode, payload = wsText, p[HeaderSize:]
+	}
+
+	if err := c.writeMessage(opcode, payload); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write a message as a single WebSocket frame. The header and payload are
+// written in a single call, so messages are never interleaved.
+func (c *WebSocketConn) writeMessage(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// Nothing may be sent after the close frame.
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	return c.writeLocked(opcode, payload)
+}
+
+// Write a message, the write mutex must be held by the caller.
+func (c *WebSocketConn) writeLocked(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !c.client {
+		frame = append(frame, payload...)
+		_, err := c.Conn.Write(frame)
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Send a close frame with the status code, if one has not already been sent.
+// The close frame is skipped while another message is being written, as the
+// write may be blocked on a slow peer and closing must never wait on it.
+func (c *WebSocketConn) sendClose(code int) {
+	if !c.wmu.TryLock() {
+		return
+	}
+	defer c.wmu.Unlock()
+
+	if !c.closeSent {
+		c.closeSent = true
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeLocked(wsClose, binary.BigEndian.AppendUint16(nil, uint16(code)))
+	}
+}
+
+// Close the connection because the peer broke the protocol. The error is
+// returned, so this can be used in a return statement.
+func (c *WebSocketConn) fail(code int, err error) error {
+	c.sendClose(code)
+	c.Conn.Close()
+	return err
+}
+
+// Close sends a close frame to the peer, then closes the underlying connection.
+func (c *WebSocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.sendClose(wsCloseNormal)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// Create the header of the frame for a text message, which is a JSON payload.
+func textHeader(size int) []byte {
+	header := make([]byte, HeaderSize)
+	binary.BigEndian.PutUint32(header[:4], uint32(size))
+	return header
+}
+
+// Adapts a read function into an io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// Create the accept key sent by the server, from the key sent by the client.
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Check if a comma separated header contains the token, ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AcceptWebSocket completes the opening handshake of a WebSocket connection on
+// the server side. The request must be for the path, and when the request was
+// sent by a browser, the origin must match the host the request was sent to.
+// This stops other websites from connecting with the certificates stored in
+// the browser.
+//
+// If the request is rejected, an HTTP error is written to the connection and
+// an error is returned, the connection is not closed.
+func AcceptWebSocket(conn net.Conn, path string) (*WebSocketConn, error) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("websocket handshake failed: %w", err)
+	}
+
+	reject := func(status int, reason string, headers ...string) (*WebSocketConn, error) {
+		res := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+		for _, header := range headers {
+			res += header + "\r\n"
+		}
+		res += fmt.Sprintf("Content-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(reason), reason)
+		conn.Write([]byte(res))
+		return nil, fmt.Errorf("websocket handshake failed: %s", reason)
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case req.URL.Path != path:
+		return reject(http.StatusNotFound, "Unknown path")
+	case req.Method != http.MethodGet:
+		return reject(http.StatusMethodNotAllowed, "Method must be GET")
+	case !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket"):
+		return reject(http.StatusUpgradeRequired, "Request must upgrade to a WebSocket", "Upgrade: websocket")
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		return reject(http.StatusUpgradeRequired, "Unsupported WebSocket version", "Sec-WebSocket-Version: 13")
+	case len(key) != 24:
+		return reject(http.StatusBadRequest, "Invalid WebSocket key")
+	}
+
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, req.Host) {
+			return reject(http.StatusForbidden, "Cross origin requests are not allowed")
+		}
+	}
+
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		return nil, fmt.Errorf("websocket handshake failed: %w", err)
+	}
+
+	return &WebSocketConn{Conn: conn, MaxMessageSize: DefaultMaxFrameSize + HeaderSize, r: r}, nil
+}
+
+// DialWebSocket completes the opening handshake of a WebSocket connection on
+// the client side. The host is sent in the Host header of the request, which
+// is the address of the server.
+func DialWebSocket(conn net.Conn, host, path string) (*WebSocketConn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, fmt.Errorf("websocket handshake failed: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, fmt.Errorf("websocket handshake failed: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake failed: server responded with %s", res.Status)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, fmt.Errorf("websocket handshake failed: invalid accept key")
+	}
+
+	return &WebSocketConn{Conn: conn, MaxMessageSize: DefaultMaxFrameSize + HeaderSize, client: true, r: r}, nil
+}
+
+// A listener which completes the WebSocket handshake of each connection before
+// it is returned by Accept.
+type websocketListener struct {
+	net.Listener
+	path string
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewWebSocketListener wraps the listener so every connection it accepts is a
+// WebSocket connection on the path. The handshakes are completed in their own
+// goroutines, so a slow client does not stop other clients from connecting.
+// Connections which fail the handshake are closed and never returned.
+//
+// Wrap a TLS listener to accept secure WebSocket connections, the underlying
+// connection of each WebSocketConn is then the TLS connection.
+func NewWebSocketListener(ln net.Listener, path string) net.Listener {
+	l := &websocketListener{
+		Listener: ln,
+		path:     path,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Accept the connections of the underlying listener, and start the handshake
+// of each one.
+func (l *websocketListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+// Complete the handshake of a connection, and pass it to Accept.
+func (l *websocketListener) handshake(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(websocketHandshakeTimeout))
+	ws, err := AcceptWebSocket(conn, l.path)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- ws:
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+// Accept returns the next connection which completed the handshake.
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close the underlying listener, connections waiting on Accept are closed.
+func (l *websocketListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
@@ -0,0 +1,341 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+)
+
+// Every event sent over the connection is wrapped in a frame. The frame
+// starts with a header, which is the length of the payload as a big endian
+// uint32 followed by a single byte of flags. The payload is the encoded
+// event.
+//
+// Without a frame, there is no way to tell where one event ends and the
+// next begins, as TCP is a stream and a single read may return part of an
+// event or multiple events.
+const HeaderSize = 5
+
+// The largest frame that will be read by default. This is a sanity limit
+// to prevent a client from making the server allocate huge buffers.
+const DefaultMaxFrameSize = 1 << 20
+
+// Default size of the read buffer when one is not provided.
+const DefaultBufSize = 1024
+
+// Number of bytes kept from the start of a frame which is too large, which
+// is enough to hold the base of the event.
+const peekSize = 512
+
+// Flags stored in the frame header. The flags describe how the payload was
+// encoded, so the reader never has to guess which codec to use.
+const (
+	// The payload is encoded with the binary codec instead of JSON.
+	FlagBinary byte = 1 << 0
+
+	// The payload is compressed with deflate. The flag is removed from the
+	// frame returned by ReadFrame once the payload has been decompressed.
+	FlagCompressed byte = 1 << 1
+
+	// Every flag understood by this package. Frames with any other flag
+	// set are rejected.
+	knownFlags = FlagBinary | FlagCompressed
+)
+
+var (
+	// ErrFrameTooLarge is returned when the length in a frame header is
+	// larger than the max frame size of the connection. When reading, the
+	// frame is discarded, so the next frame can still be read.
+	ErrFrameTooLarge = errors.New("frame exceeds the max frame size")
+
+	// ErrLegacyProtocol is returned when the peer is sending raw JSON events
+	// without a frame. This is how clients built before the handshake was
+	// added talk to the server, they can be rejected using this error.
+	ErrLegacyProtocol = errors.New("peer is using the unframed legacy protocol")
+)
+
+// Conn wraps a net.Conn and handles reading and writing frames. The Conn
+// embeds the net.Conn so it can be used anywhere a net.Conn is expected, but
+// events must be written using the WriteEvent or WriteFrame methods, writing
+// directly to the connection will corrupt the stream.
+//
+// Writes are protected by a mutex, so a Conn can be written to from multiple
+// goroutines. Reads are not, there should only ever be a single goroutine
+// reading from the connection. The codec and compression settings have their
+// own mutex, so they can be read while a write is blocked.
+type Conn struct {
+	net.Conn
+
+	// The largest payload that will be accepted by ReadFrame.
+	MaxFrameSize int
+
+	// Compression stats for the frames read and written, nil to
+	// disable tracking. This can be shared between connections.
+	Stats *Stats
+
+	// Time allowed for each frame to be written, after which the
+	// write fails. When zero, writes have no deadline.
+	WriteTimeout time.Duration
+
+	// Codec used to encode the events written by WriteEvent.
+	codec events.Codec
+
+	// Payloads at least as large as the threshold are compressed
+	// when compression is enabled.
+	compress  bool
+	threshold int
+
+	// Protects the codec and compression settings.
+	smu sync.RWMutex
+
+	r   *bufio.Reader
+	wmu sync.Mutex
+}
+
+// Frame is a single frame read from the connection.
+type Frame struct {
+	Flags   byte
+	Payload []byte
+}
+
+// Codec returns the codec the payload was encoded with.
+func (f Frame) Codec() events.Codec {
+	if f.Flags&FlagBinary != 0 {
+		return events.Binary
+	}
+	return events.JSON
+}
+
+// Decode parses the event in the payload, using the codec the payload was
+// encoded with. See the events.Parser for details on the returned event.
+func (f Frame) Decode() (interface{}, error) {
+	return events.ParseWith(f.Codec(), f.Payload)
+}
+
+// DecodeBase parses only the base of the event in the payload.
+func (f Frame) DecodeBase() (events.BaseEvent, error) {
+	return f.Codec().UnmarshalBase(f.Payload)
+}
+
+// PeekBase decodes as much of the base of the event as it can, the payload
+// may be truncated. This is used for the frames returned by ReadFrame along
+// with ErrFrameTooLarge. The base of a compressed payload cannot be peeked,
+// so an empty base is returned.
+func (f Frame) PeekBase() events.BaseEvent {
+	if f.Flags&FlagCompressed != 0 {
+		return events.BaseEvent{}
+	}
+	return events.PeekBase(f.Codec(), f.Payload)
+}
+
+// String returns a printable version of the payload, which is used for
+// debug logs. Binary payloads are not printable, so only the size is shown.
+func (f Frame) String() string {
+	if f.Flags&FlagBinary != 0 {
+		return fmt.Sprintf("<binary event: %d bytes>", len(f.Payload))
+	}
+	return string(f.Payload)
+}
+
+// CodecFlags returns the frame flags for payloads encoded with the codec.
+func CodecFlags(codec events.Codec) byte {
+	if codec == events.Binary {
+		return FlagBinary
+	}
+	return 0
+}
+
+// Create a new Conn which wraps the connection. The buffer size is the size
+// of the read buffer, frames larger than the buffer can still be read.
+func NewConn(conn net.Conn, bufSize int) *Conn {
+	if bufSize <= 0 {
+		bufSize = DefaultBufSize
+	}
+
+	return &Conn{
+		Conn:         conn,
+		MaxFrameSize: DefaultMaxFrameSize,
+		codec:        events.JSON,
+		r:            bufio.NewReaderSize(conn, bufSize),
+	}
+}
+
+// Wrap returns the connection as a Conn. If the connection is already a Conn
+// it is returned as is, otherwise a new Conn is created with the default
+// options. This allows functions which are passed a net.Conn to write frames.
+func Wrap(conn net.Conn) *Conn {
+	if c, ok := conn.(*Conn); ok {
+		return c
+	}
+	return NewConn(conn, DefaultBufSize)
+}
+
+// Codec returns the codec used to encode the events written to the connection.
+func (c *Conn) Codec() events.Codec {
+	c.smu.RLock()
+	defer c.smu.RUnlock()
+	return c.codec
+}
+
+// SetCodec changes the codec used to encode the events written to the
+// connection. The codec used to read events is stored in each frame, so
+// it does not need to be set.
+//
+// Events which have already been written are not affected, so the codec
+// can be switched as soon as the welcome event has been written.
+func (c *Conn) SetCodec(codec events.Codec) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.codec = codec
+}
+
+// EnableCompression compresses every payload written to the connection which
+// is at least as large as the threshold. Compressed frames can always be read,
+// so this only affects writes.
+func (c *Conn) EnableCompression(threshold int) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.compress = true
+	c.threshold = threshold
+}
+
+// ReadFrame reads a single frame from the connection. This will block until
+// an entire frame has been read.
+//
+// If the frame is larger than the max frame size, ErrFrameTooLarge is returned
+// along with the start of the payload, see Frame.PeekBase.
+//
+// If the peer is sending unframed JSON, ErrLegacyProtocol is returned and
+// nothing is consumed from the connection.
+func (c *Conn) ReadFrame() (Frame, error) {
+	header, err := c.r.Peek(HeaderSize)
+	if err != nil {
+		// A partial header followed by EOF means the connection was closed
+		// in the middle of a frame.
+		if errors.Is(err, io.EOF) && len(header) > 0 {
+			return Frame{}, io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	// A JSON event always starts with an opening brace, which would be a
+	// length of over 2GB, so it can never be a valid frame.
+	if header[0] == '{' {
+		return Frame{}, ErrLegacyProtocol
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	flags := header[4]
+	if _, err := c.r.Discard(HeaderSize); err != nil {
+		return Frame{}, err
+	}
+
+	// The payload is discarded without being stored, so the connection
+	// stays in sync and can be used for the next frame. Only the start of
+	// the payload is returned, so the base of the event can be peeked.
+	if int64(size) > int64(c.MaxFrameSize) {
+		prefix := make([]byte, min(int(size), peekSize))
+		if _, err := io.ReadFull(c.r, prefix); err != nil {
+			return Frame{}, err
+		}
+		if _, err := c.r.Discard(int(size) - len(prefix)); err != nil {
+			return Frame{}, err
+		}
+		return Frame{Flags: flags, Payload: prefix}, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+	if flags&^knownFlags != 0 {
+		return Frame{}, fmt.Errorf("unsupported frame flags: %08b", flags)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return Frame{}, err
+	}
+
+	if flags&FlagCompressed != 0 {
+		compressed := len(payload)
+		if payload, err = decompress(payload, c.MaxFrameSize); errors.Is(err, ErrFrameTooLarge) {
+			return Frame{Flags: flags &^ FlagCompressed, Payload: payload}, err
+		} else if err != nil {
+			return Frame{}, err
+		}
+		flags &^= FlagCompressed
+		c.Stats.recordCompressed(len(payload), compressed)
+	}
+
+	return Frame{Flags: flags, Payload: payload}, nil
+}
+
+// WriteFrame writes the payload to the connection as a single frame. The
+// header and payload are written in a single call so frames written by
+// different goroutines are never interleaved.
+func (c *Conn) WriteFrame(flags byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrame(flags, payload)
+}
+
+// WriteEvent encodes the event with the codec of the connection and writes
+// it as a single frame.
+func (c *Conn) WriteEvent(event interface{}) error {
+	codec := c.Codec()
+	payload, err := codec.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrame(CodecFlags(codec), payload)
+}
+
+// Write a frame, the write mutex must be held by the caller. The payload is
+// compressed here if compression is enabled and the payload is large enough.
+func (c *Conn) writeFrame(flags byte, payload []byte) error {
+	if len(payload) > c.MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(payload))
+	}
+
+	c.smu.RLock()
+	enabled, threshold := c.compress, c.threshold
+	c.smu.RUnlock()
+
+	if enabled && len(payload) >= threshold {
+		compressed, err := compress(payload)
+		if err != nil {
+			return err
+		}
+
+		// Some payloads get larger when compressed, those are sent as is.
+		if len(compressed) < len(payload) {
+			c.Stats.recordCompressed(len(payload), len(compressed))
+			flags |= FlagCompressed
+			payload = compressed
+		} else {
+			c.Stats.recordUncompressed()
+		}
+	} else if enabled {
+		c.Stats.recordUncompressed()
+	}
+
+	frame := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	frame[4] = flags
+	copy(frame[HeaderSize:], payload)
+
+	if c.WriteTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,100 @@
+package tnm
+
+import (
+	"time"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+)
+
+// Event is implemented by every event delivered to subscribers. Use a type
+// switch to handle the events you are interested in, new event types may be
+// added in later versions so unknown types should be ignored.
+type Event interface {
+	// Time the event was created by the server.
+	Time() time.Time
+}
+
+// Message is a message published by a client and broadcast by the server.
+type Message struct {
+	// ID of the client which published the message, or the name of the
+	// publisher when the message was published over HTTP.
+	Sender string
+
+	// Text of the message.
+	Text string
+
+	// Optional title and topic of the message, and its priority, which is
+	// empty for the normal priority.
+	Title    string
+	Topic    string
+	Priority string
+
+	Timestamp time.Time
+}
+
+// ClientJoined is delivered when a client authenticates with the server.
+type ClientJoined struct {
+	// ID of the client, and the name of its device. The device is empty
+	// when the server does not use TLS.
+	ClientID string
+	Device   string
+
+	Timestamp time.Time
+}
+
+// ClientLeft is delivered when a client disconnects from the server, or is
+// kicked by an admin.
+type ClientLeft struct {
+	// ID of the client, and the name of its device. The device is empty
+	// when the server does not use TLS.
+	ClientID string
+	Device   string
+
+	Timestamp time.Time
+}
+
+// ShuttingDown is delivered when the server is shutting down. The connection
+// is closed by the server once the remaining events have been delivered.
+type ShuttingDown struct {
+	// Why the server is shutting down.
+	Reason string
+
+	// How long to wait before reconnecting.
+	ReconnectAfter time.Duration
+
+	Timestamp time.Time
+}
+
+func (e Message) Time() time.Time      { return e.Timestamp }
+func (e ClientJoined) Time() time.Time { return e.Timestamp }
+func (e ClientLeft) Time() time.Time   { return e.Timestamp }
+func (e ShuttingDown) Time() time.Time { return e.Timestamp }
+
+// Convert an event parsed by the events package into the public event type.
+// False is returned for events which are not delivered to subscribers, such
+// as responses to requests.
+func convert(event interface{}) (Event, bool) {
+	switch e := event.(type) {
+	case *events.BroadcastMessageEvent:
+		return Message{
+			Sender:    e.Content.Sender,
+			Text:      e.Content.Message,
+			Title:     e.Content.Title,
+			Topic:     e.Content.Topic,
+			Priority:  e.Content.Priority,
+			Timestamp: e.Timestamp,
+		}, true
+	case *events.ClientAuthenticatedEvent:
+		return ClientJoined{ClientID: e.Content.ClientID, Device: e.Content.Device, Timestamp: e.Timestamp}, true
+	case *events.ClientDisconnectedEvent:
+		return ClientLeft{ClientID: e.Content.ClientID, Device: e.Content.Device, Timestamp: e.Timestamp}, true
+	case *events.ServerShuttingDownEvent:
+		return ShuttingDown{
+			Reason:         e.Content.Reason,
+			ReconnectAfter: time.Duration(e.Content.ReconnectAfter) * time.Second,
+			Timestamp:      e.Timestamp,
+		}, true
+	default:
+		return nil, false
+	}
+}
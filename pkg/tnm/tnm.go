@@ -0,0 +1,387 @@
+// Package tnm is the public client for the TCP Notification Manager, which
+// allows other Go programs, such as CI runners and backup daemons, to publish
+// messages and receive the events broadcast by the server.
+//
+// The client connects, completes the handshake and authenticates in Dial, so
+// it is ready to be used once Dial returns:
+//
+//	client, err := tnm.Dial(ctx, tnm.Options{
+//	    Addr:       "vpn.gophernest.net",
+//	    Port:       3005,
+//	    CertFile:   "./certs/client.crt",
+//	    KeyFile:    "./certs/client.key",
+//	    CAFile:     "./certs/ca.crt",
+//	    ServerName: "vpn.gophernest.net",
+//	})
+//	if err != nil {
+//	    return err
+//	}
+//	defer client.Close()
+//
+//	if err := client.Publish(ctx, "Backup finished"); err != nil {
+//	    return err
+//	}
+//
+// Unlike the internal client, every error is returned to the caller, and the
+// client never logs unless a log output is provided.
+package tnm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Azpect3120/TCPNotificationManager/internal/client"
+	"github.com/Azpect3120/TCPNotificationManager/internal/events"
+	"github.com/Azpect3120/TCPNotificationManager/internal/logger"
+)
+
+// Number of events which can be waiting to be received on each subscription.
+// Once a subscriber falls further behind, the client stops reading events
+// until it catches up.
+const subscriberBuffer = 64
+
+// ErrClosed is returned when using a client which has been closed, or whose
+// connection to the server has been lost.
+var ErrClosed = errors.New("tnm: client is closed")
+
+// Options used to connect to the server. The zero value connects to a server
+// on 127.0.0.1:8080 without TLS.
+type Options struct {
+	// Address and port of the server.
+	Addr string
+	Port int
+
+	// Certificate and key of the device, and the CA used to verify the
+	// server, which are created with the 'tnm pki' command. TLS is used
+	// when the CA file is provided. The server name must match one of the
+	// names in the server certificate.
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+
+	// Path of the server's WebSocket endpoint. When set, the client
+	// connects over WebSocket, and the port must be the WebSocket port
+	// of the server.
+	WebSocketPath string
+
+	// Path of the server's Unix socket. When set, the client connects
+	// over the socket and is identified by the user running it, the
+	// address, port and TLS options are ignored.
+	UnixSocket string
+
+	// Token sent to the server when authenticating.
+	Token string
+
+	// Largest event, in bytes, the client will accept from the server.
+	// When zero, the default of the wire package is used.
+	MaxEventSize int
+
+	// Where the client writes its logs, nothing is logged when nil.
+	LogOutput io.Writer
+}
+
+// Client is a connection to the server. The methods are safe to call from
+// multiple goroutines.
+type Client struct {
+	client *client.TcpClient
+	conn   net.Conn
+
+	// The active subscriptions. Once the connection is lost, stopped is set
+	// and no more subscriptions are added.
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	stopped     bool
+
+	// Closed once the connection to the server has been lost, err stores
+	// why, it is nil when the connection was closed by Close.
+	done chan struct{}
+	err  error
+
+	// Closed by Close, which stops any delivery waiting on a subscriber.
+	closing   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// A single subscription. The mutex is held while sending on the channel, so
+// the channel is never closed during a send.
+type subscriber struct {
+	ctx    context.Context
+	ch     chan Event
+	mu     sync.Mutex
+	closed bool
+}
+
+// Close the channel of the subscriber, if it has not already been closed.
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// Dial connects to the server, completes the handshake and authenticates. The
+// context limits how long this may take, it has no effect on the client once
+// it is returned.
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	clientOpts := []client.ClientOptsFunc{}
+	if opts.Addr != "" {
+		clientOpts = append(clientOpts, client.WithAddr(opts.Addr))
+	}
+	if opts.Port != 0 {
+		clientOpts = append(clientOpts, client.WithPort(opts.Port))
+	}
+	if opts.MaxEventSize != 0 {
+		clientOpts = append(clientOpts, client.WithMaxEventSize(opts.MaxEventSize))
+	}
+	if opts.CAFile != "" {
+		clientOpts = append(clientOpts, client.WithTLS())
+	}
+	if opts.WebSocketPath != "" {
+		clientOpts = append(clientOpts, client.WithWebSocket(opts.WebSocketPath))
+	}
+	if opts.UnixSocket != "" {
+		clientOpts = append(clientOpts, client.WithUnixSocket(opts.UnixSocket))
+	}
+
+	tc := client.NewTCPClient(clientOpts...)
+
+	output := opts.LogOutput
+	if output == nil {
+		output = io.Discard
+	}
+	tc.Logger = logger.NewLogger(logger.WithDefaultLevel(logger.INFO), logger.WithTimestamp(), logger.WithOutput(output))
+
+	if opts.CAFile != "" {
+		config, err := client.LoadTLSConfig(opts.CertFile, opts.KeyFile, opts.CAFile, opts.ServerName)
+		if err != nil {
+			return nil, err
+		}
+		tc.TLSConfig = config
+	}
+
+	c := &Client{
+		client:      tc,
+		subscribers: make(map[*subscriber]struct{}),
+		done:        make(chan struct{}),
+		closing:     make(chan struct{}),
+	}
+	c.registerHandlers()
+
+	conn, err := tc.ConnectContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	go c.listen()
+
+	auth := events.NewRequestAuthenticationEvent(opts.Token)
+	if _, err := tc.Request(ctx, conn, &auth); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Replace the handlers of the internal client, which show desktop
+// notifications. The events are delivered to the subscribers instead.
+func (c *Client) registerHandlers() {
+	tc := c.client
+	tc.EventHandlers = make(map[string]interface{})
+
+	client.RegisterEventHandler(tc, "ConnectionAcceptedEvent", func(tc *client.TcpClient, event *events.ConnectionAcceptedEvent) {
+		tc.ID = event.Content.ClientID
+	})
+	client.RegisterEventHandler(tc, "ErrorEvent", client.ErrorHandler)
+}
+
+// Read the events sent by the server until the connection is closed, then
+// end every subscription.
+func (c *Client) listen() {
+	for event := range c.client.Events(context.Background(), c.conn) {
+		if e, ok := convert(event); ok {
+			c.deliver(e)
+		}
+	}
+
+	// The error which stopped the read loop is the last one added by Events,
+	// it is safe to read once the channel is closed.
+	c.mu.Lock()
+	if n := len(c.client.Errors); n > 0 {
+		c.err = c.client.Errors[n-1]
+	}
+	c.stopped = true
+	subscribers := c.subscribers
+	c.subscribers = nil
+	c.mu.Unlock()
+
+	for sub := range subscribers {
+		sub.close()
+	}
+	close(c.done)
+}
+
+// Deliver the event to every subscriber. This waits for each subscriber to
+// receive the event, which stops the client from reading more events, so the
+// server applies its queue policy once the subscribers fall too far behind.
+func (c *Client) deliver(event Event) {
+	c.mu.Lock()
+	subscribers := make([]*subscriber, 0, len(c.subscribers))
+	for sub := range c.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	c.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.mu.Lock()
+		if !sub.closed {
+			select {
+			case sub.ch <- event:
+			case <-sub.ctx.Done():
+			case <-c.closing:
+			}
+		}
+		sub.mu.Unlock()
+	}
+}
+
+// ID returns the ID the server gave the client when it authenticated.
+func (c *Client) ID() string {
+	return c.client.ID
+}
+
+// Publish sends a message which is broadcast by the server to the other
+// clients. When the server supports acks, this waits for the server to
+// accept the message, and errors returned by the server, such as being
+// rate limited or not having the publish permission, are returned.
+func (c *Client) Publish(ctx context.Context, message string) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	msg := events.NewSendMessageEvent(c.client.ID, message)
+	return c.request(ctx, &msg)
+}
+
+// Heartbeat tells the server that the scheduled job of the check has run, so
+// the server does not alert the other clients that the check was missed. When
+// the server supports acks, errors returned by the server, such as the check
+// not being configured on the server, are returned.
+func (c *Client) Heartbeat(ctx context.Context, check string) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	event := events.NewHeartbeatEvent(c.client.ID, check)
+	return c.request(ctx, &event)
+}
+
+// Send the event to the server. When the server supports acks, this waits for
+// the response, and returns the error sent by the server if there is one.
+func (c *Client) request(ctx context.Context, event events.Event) error {
+	if !c.client.HasFeature(events.FeatureAcks) {
+		return c.client.Send(c.conn, event)
+	}
+
+	// Stop waiting on the response if the connection is lost.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-c.done:
+			cancel(ErrClosed)
+		case <-ctx.Done():
+		}
+	}()
+
+	if _, err := c.client.Request(ctx, c.conn, event); err != nil {
+		if errors.Is(context.Cause(ctx), ErrClosed) {
+			return ErrClosed
+		}
+		return err
+	}
+	return nil
+}
+
+// Subscribe returns a channel which receives the events broadcast by the
+// server, such as messages published by other clients. The channel is closed
+// when the context is cancelled or the client is closed.
+//
+// The channel is buffered, but once a subscriber falls too far behind, the
+// client stops reading events until it catches up. Responses to Publish are
+// read along with the events, so the channel should be drained promptly.
+func (c *Client) Subscribe(ctx context.Context) <-chan Event {
+	sub := &subscriber{ctx: ctx, ch: make(chan Event, subscriberBuffer)}
+
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		sub.close()
+		return sub.ch
+	}
+	c.subscribers[sub] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.done:
+			return
+		}
+
+		c.mu.Lock()
+		delete(c.subscribers, sub)
+		c.mu.Unlock()
+		sub.close()
+	}()
+
+	return sub.ch
+}
+
+// Done returns a channel which is closed once the connection to the server
+// has been closed, either by Close or by the server.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection to the server was lost. It is nil while the
+// client is connected, and when the connection was closed without an error.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close tells the server the client is disconnecting and closes the
+// connection, every subscription is ended. Close waits for the client to stop
+// reading events, and is safe to call more than once.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+
+		select {
+		case <-c.done:
+			// The connection has already been lost.
+		default:
+			c.closeErr = c.client.Send(c.conn, events.NewClientDisconnectingEvent(c.client.ID))
+		}
+
+		if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			c.closeErr = errors.Join(c.closeErr, err)
+		}
+		<-c.done
+	})
+	return c.closeErr
+}
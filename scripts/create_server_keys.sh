@@ -1,13 +1,24 @@
 #!/usr/bin/env bash
 
-# Clear old crt and key files
-rm ./certs/*
+# Create the certificate authority, server certificate and a client certificate
+# for this machine using the tnm pki command. Existing files are never overwritten,
+# remove ./certs/ca.* to start over with a new CA.
+#
+# Usage: ./scripts/create_server_keys.sh [device-name]
+set -euo pipefail
 
-# Generate a self-signed certificate with SAN (Subject Alternative Name)
-openssl req -x509 -newkey rsa:4096 -nodes -keyout ./certs/server.key -out ./certs/server.crt -days 365 \
-    -addext "subjectAltName=DNS:vpn.gophernest.net,DNS:www.vpn.gophernest.net,DNS:localhost,IP:127.0.0.1" \
-    -subj "/O=Gophernest/OU=Notifications/L=Surprise/ST=Arizona/C=US"
+DEVICE="${1:-$(hostname)}"
+TNM="go run ./cmd/tnm"
 
-# Generate a self-signed certificate with SAN (Subject Alternative Name)
-openssl req -x509 -newkey rsa:4096 -nodes -keyout ./certs/client.key -out ./certs/client.crt -days 365 \
-    -subj "/CN=testingclient/O=Gophernest/OU=Notifications"
+# Create the CA, unless one already exists
+if [ ! -f ./certs/ca.crt ]; then
+    $TNM pki init -dir ./certs
+fi
+
+# Issue the server certificate with SAN (Subject Alternative Name)
+$TNM pki server -dir ./certs -hosts "vpn.gophernest.net,www.vpn.gophernest.net,localhost,127.0.0.1"
+
+# Issue a client certificate for the device, and copy it to the paths used by cmd/client
+$TNM pki client -dir ./certs -device "$DEVICE"
+cp "./certs/clients/$DEVICE.crt" ./certs/client.crt
+cp "./certs/clients/$DEVICE.key" ./certs/client.key